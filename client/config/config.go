@@ -2,6 +2,10 @@ package config
 
 import (
 	"../encrypt"
+	"../mux"
+	"../pool"
+	"../proxy"
+	"../route"
 	"encoding/json"
 	"flag"
 	"log"
@@ -15,11 +19,32 @@ import (
 type Client struct {
 	Socksserver string `json:"socksserver"`
 	Socksclient string `json:"socksclient"`
+	Socksuser   string `json:"socksuser"`
+	Sockspass   string `json:"sockspass"`
+	Httpclient  string `json:"httpclient"`
+	Mixedclient string `json:"mixedclient"`
+	Redirclient string `json:"redirclient"`
+	Redirmode   string `json:"redirmode"`
+	Rules       string `json:"rules"`
 	Compression string `json:"compression"`
+	Cipher      string `json:"cipher"`
+	Maxframe    int    `json:"maxframe"`
+	Padding     string `json:"padding"`
+	Mux         bool   `json:"mux"`
+	Muxconns    int    `json:"muxconns"`
+	Pool        int    `json:"pool"`
+	Poolttl     int    `json:"poolttl"`
 	Tcpserver   string `json:"tcpserver"`
 	Tcpclient   string `json:"tcpclient"`
 	Psk         string `json:"key"`
+	Salt        string `json:"salt"`
+	Kdftime     uint32 `json:"kdftime"`
+	Kdfmemory   uint32 `json:"kdfmemory"`
+	Kdfthreads  uint8  `json:"kdfthreads"`
+	Legacykdf   bool   `json:"legacykdf"`
 	keyring     *encrypt.Keyring
+	options     *encrypt.Options
+	router      *route.Router
 }
 
 func LoadClientConf() *Client {
@@ -29,6 +54,10 @@ func LoadClientConf() *Client {
 	tcpclient := flag.String("a", "", "Tcp client address")
 	config := flag.String("c", "", "Configuration path")
 	comp := flag.String("z", "", "Use compression")
+	cipher := flag.String("m", "", "Cipher method")
+	padding := flag.String("d", "", "Padding policy")
+	rules := flag.String("r", "", "Routing rules path")
+	multiplex := flag.Bool("x", false, "Multiplex socks connections")
 	Psk := flag.String("p", "", "Pre-shared Keyring")
 	flag.Parse()
 
@@ -60,16 +89,59 @@ func LoadClientConf() *Client {
 	if *comp != "" {
 		client.Compression = *comp
 	}
+	if *cipher != "" {
+		client.Cipher = *cipher
+	}
+	if *padding != "" {
+		client.Padding = *padding
+	}
 	if *Psk != "" {
 		client.Psk = *Psk
 	}
+	if *multiplex {
+		client.Mux = true
+	}
+	if *rules != "" {
+		client.Rules = *rules
+	}
 
-	if len(client.Socksserver)*len(client.Socksclient) == 0 && len(client.Tcpserver)*len(client.Tcpclient) == 0 {
+	if len(client.Salt) == 0 {
+		client.Salt = encrypt.KdfSalt
+	}
+	if client.Kdftime == 0 {
+		client.Kdftime = encrypt.KdfTime
+	}
+	if client.Kdfmemory == 0 {
+		client.Kdfmemory = encrypt.KdfMemory
+	}
+	if client.Kdfthreads == 0 {
+		client.Kdfthreads = encrypt.KdfThreads
+	}
+	if client.Muxconns == 0 {
+		client.Muxconns = mux.PoolSize
+	}
+	if client.Poolttl == 0 {
+		client.Poolttl = pool.TTL
+	}
+
+	if len(client.Socksserver)*(len(client.Socksclient)+len(client.Httpclient)+len(client.Mixedclient)+len(client.Redirclient)) == 0 && len(client.Tcpserver)*len(client.Tcpclient) == 0 {
 		log.Fatalln("INVALID ARGS FOR LISTENING ADDRESS")
 	}
 	if len(client.Socksclient) > 0 && !validateIP(client.Socksclient) {
 		log.Fatalln("INVALID SOCKS CLIENT IP ADDRESS")
 	}
+	if len(client.Httpclient) > 0 && !validateIP(client.Httpclient) {
+		log.Fatalln("INVALID HTTP CLIENT IP ADDRESS")
+	}
+	if len(client.Mixedclient) > 0 && !validateIP(client.Mixedclient) {
+		log.Fatalln("INVALID MIXED CLIENT IP ADDRESS")
+	}
+	if len(client.Redirclient) > 0 && !validateIP(client.Redirclient) {
+		log.Fatalln("INVALID REDIRECT CLIENT IP ADDRESS")
+	}
+	if client.Redirmode != "" && client.Redirmode != "redirect" && client.Redirmode != "tproxy" {
+		log.Fatalln("REDIRMODE MUST BE redirect OR tproxy")
+	}
 	if len(client.Tcpclient) > 0 && !validateIP(client.Tcpclient) {
 		log.Fatalln("INVALID TCP CLIENT ADDRESS")
 	}
@@ -84,6 +156,38 @@ func LoadClientConf() *Client {
 		}
 	}
 
+	if _, err := encrypt.NewAEAD(client.Cipher, new([32]byte)); err != nil {
+		log.Fatalf("INVALID CIPHER: %v", err)
+	}
+	if client.Maxframe != 0 && (client.Maxframe < encrypt.MinFrame || client.Maxframe > 65535) {
+		log.Fatalf("MAXFRAME MUST BE BETWEEN %d AND 65535", encrypt.MinFrame)
+	}
+	if _, err := encrypt.ParsePadding(client.Padding); err != nil {
+		log.Fatalf("INVALID PADDING: %v", err)
+	}
+	if client.Muxconns < 0 {
+		log.Fatalln("MUXCONNS MUST BE POSITIVE")
+	}
+	if len(client.Socksuser) > 255 || len(client.Sockspass) > 255 {
+		log.Fatalln("SOCKS USER AND PASSWORD MUST BE AT MOST 255 BYTES")
+	}
+	if len(client.Sockspass) > 0 && len(client.Socksuser) == 0 {
+		log.Fatalln("SOCKS PASSWORD SET WITHOUT USER")
+	}
+	if client.Pool < 0 || client.Poolttl < 0 {
+		log.Fatalln("POOL AND POOLTTL MUST BE POSITIVE")
+	}
+
+	if len(client.Rules) > 0 {
+		router, err := route.Load(client.Rules)
+		if err != nil {
+			log.Fatalf("INVALID ROUTING RULES: %v", err)
+		}
+		client.router = router
+	}
+
+	client.Getkeyring()
+	client.Getoptions()
 	return client
 }
 
@@ -114,7 +218,35 @@ func validateDomain(s string) bool {
 
 func (c *Client) Getkeyring() *encrypt.Keyring {
 	if c.keyring == nil {
-		c.keyring = encrypt.NewKeyring(c.Psk)
+		if c.Legacykdf {
+			log.Println("USING LEGACY KEY DERIVATION")
+			c.keyring = encrypt.NewKeyring(c.Psk)
+		} else {
+			c.keyring = encrypt.NewKeyringArgon2(c.Psk, c.Salt, c.Kdftime, c.Kdfmemory, c.Kdfthreads)
+		}
 	}
 	return c.keyring
 }
+
+func (c *Client) Getoptions() *encrypt.Options {
+	if c.options == nil {
+		padding, _ := encrypt.ParsePadding(c.Padding)
+		c.options = &encrypt.Options{
+			Cipher:   c.Cipher,
+			MaxFrame: c.Maxframe,
+			Padding:  padding,
+		}
+	}
+	return c.options
+}
+
+func (c *Client) Getauth() *proxy.Auth {
+	if len(c.Socksuser) == 0 {
+		return nil
+	}
+	return &proxy.Auth{User: c.Socksuser, Pass: c.Sockspass}
+}
+
+func (c *Client) Getrouter() *route.Router {
+	return c.router
+}
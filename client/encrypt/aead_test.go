@@ -0,0 +1,49 @@
+package encrypt
+
+import "testing"
+
+var ciphers = []string{Secretbox, Chacha20Poly1305, Aes256Gcm}
+
+func BenchmarkSeal(b *testing.B) {
+	for _, name := range ciphers {
+		b.Run(name, func(b *testing.B) {
+			var key [32]byte
+			aead, err := NewAEAD(name, &key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			nonce := make([]byte, aead.NonceSize())
+			frame := make([]byte, MaxFrame)
+			buf := make([]byte, 0, MaxFrame+aead.Overhead())
+
+			b.SetBytes(int64(len(frame)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				aead.Seal(buf[:0], nonce, frame, nil)
+			}
+		})
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	for _, name := range ciphers {
+		b.Run(name, func(b *testing.B) {
+			var key [32]byte
+			aead, err := NewAEAD(name, &key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			nonce := make([]byte, aead.NonceSize())
+			sealed := aead.Seal(nil, nonce, make([]byte, MaxFrame), nil)
+			buf := make([]byte, 0, MaxFrame)
+
+			b.SetBytes(int64(MaxFrame))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := aead.Open(buf[:0], nonce, sealed, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,21 +1,83 @@
 package encrypt
 
 import (
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
-	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 	mr "math/rand"
 )
 
+const (
+	Version        string = "torii/9"
+	HelloLen       int    = 48
+	ServerHelloLen int    = 56
+	TimeLen        int    = 24
+	MaxFrame       int    = 16384
+	MinFrame       int    = 64
+)
+
+const (
+	KdfSalt    string = "torii"
+	KdfTime    uint32 = 3
+	KdfMemory  uint32 = 64 * 1024
+	KdfThreads uint8  = 4
+)
+
+type Options struct {
+	offset   int64
+	Cipher   string
+	MaxFrame int
+	Padding  *Padding
+	pool     sync.Pool
+}
+
+// Offset of the server clock in seconds, learned from server hellos.
+func (o *Options) Offset() int64 {
+	return atomic.LoadInt64(&o.offset)
+}
+
+func (o *Options) setOffset(t []byte) {
+	offset := int64(binary.BigEndian.Uint64(t)) - time.Now().Unix()
+	if old := atomic.SwapInt64(&o.offset, offset); Abs(int(old-offset)) > 1 {
+		log.Printf("CLOCK OFFSET TO SERVER: %ds", offset)
+	}
+}
+
+func (o *Options) maxFrame() int {
+	if o.MaxFrame > 0 {
+		return o.MaxFrame
+	}
+	return MaxFrame
+}
+
+// Receive buffers hold the sealed frame in the first half and the opened frame in the second.
+func (o *Options) getBuf() *[]byte {
+	if b, ok := o.pool.Get().(*[]byte); ok {
+		return b
+	}
+	b := make([]byte, 2*(o.maxFrame()+64))
+	return &b
+}
+
+func (o *Options) putBuf(b *[]byte) {
+	o.pool.Put(b)
+}
+
 type Keyring struct {
 	k_cipher *[32]byte
-	k_nonce []byte
+	k_auth []byte
 	k_client []byte
 	k_server []byte
 	k_timestamp []byte
@@ -24,14 +86,14 @@ type Keyring struct {
 }
 
 func NewKeyring(s string) *Keyring {
-	k_nonce := SH256L([]byte("k_nonce_" + s))
+	k_auth := SH256L([]byte("k_auth_" + s))
 	k_client := SH256L([]byte("k_client_" + s))
 	k_server := SH256L([]byte("k_server_" + s))
 	k_timestamp := SH256L([]byte("k_timestamp_" + s))
 	k_chksum := SH256L([]byte("k_chksum_" + s))
 	k_cipher := sha256.Sum256([]byte("k_cipher_" + s))
 	return &Keyring{
-		k_nonce: k_nonce,
+		k_auth: k_auth,
 		k_client: k_client,
 		k_server: k_server,
 		k_timestamp: k_timestamp,
@@ -40,85 +102,232 @@ func NewKeyring(s string) *Keyring {
 	}
 }
 
+// Derive subkeys from an Argon2id master key instead of plain SHA-256 of the passphrase.
+// memory is in KiB.
+func NewKeyringArgon2(s, salt string, iter, memory uint32, threads uint8) *Keyring {
+	master := argon2.IDKey([]byte(s), []byte(salt), iter, memory, threads, 32)
+	expand := func(label string) []byte {
+		k := make([]byte, 32)
+		io.ReadFull(hkdf.Expand(sha256.New, master, []byte(label)), k)
+		return k
+	}
+	var k_cipher [32]byte
+	copy(k_cipher[:], expand("k_cipher"))
+	return &Keyring{
+		k_auth: expand("k_auth"),
+		k_client: expand("k_client"),
+		k_server: expand("k_server"),
+		k_timestamp: expand("k_timestamp"),
+		k_chksum: expand("k_chksum"),
+		k_cipher: &k_cipher,
+	}
+}
+
 type EncStreamClient struct {
 	net.Conn
 	keyring        *Keyring
+	opts           *Options
 	rBuf, dBuf     []byte
-	rNonce, sNonce [24]byte
+	lBuf, lPlain   []byte
+	pBuf           *[]byte
+	rAEAD, sAEAD   cipher.AEAD
+	rNonce, sNonce []byte
+	once           sync.Once
+	err            error
 }
 
-func NewEncStreamClient(conn net.Conn, keys *Keyring) *EncStreamClient {
-	e := &EncStreamClient{
+func NewEncStreamClient(conn net.Conn, keys *Keyring, opts *Options) *EncStreamClient {
+	return &EncStreamClient{
 		Conn:    conn,
 		keyring: keys,
+		opts:    opts,
 		dBuf:    make([]byte, 8),
 	}
-	copy(e.rNonce[:8], keys.k_nonce[:8])
-	copy(e.sNonce[:8], keys.k_nonce[24:])
-	return e
+}
+
+func (e *EncStreamClient) Handshake() error {
+	e.once.Do(func() {
+		e.err = e.handshake()
+	})
+	return e.err
+}
+
+func (e *EncStreamClient) handshake() error {
+	priv, pub, err := Ephemeral()
+	if err != nil {
+		return err
+	}
+
+	hello := append(ClientEncode(HelloLen, e.keyring, e.opts.Offset()), pub...)
+	hello = append(hello, HelloMAC(e.keyring, hello)...)
+	if _, err := e.Conn.Write(hello); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(e.Conn, e.dBuf); err != nil {
+		return err
+	}
+	size, _ := ClientDecode(e.dBuf, e.keyring)
+	if size != ServerHelloLen && size != TimeLen {
+		log.Println("INVALID SERVER HELLO")
+		return errors.New("Handshake failed")
+	}
+	c := make([]byte, size)
+	if _, err := io.ReadFull(e.Conn, c); err != nil {
+		return err
+	}
+	if !hmac.Equal(c[size-16:], HelloMAC(e.keyring, hello[16:48], e.dBuf, c[:size-16])) {
+		log.Println("SERVER AUTHENTICATION FAILED")
+		return errors.New("Handshake failed")
+	}
+	e.opts.setOffset(c[size-24 : size-16])
+	if size == TimeLen {
+		log.Println("CLIENT CLOCK OUT OF SYNC, RETRY WITH CORRECTED TIME")
+		return errors.New("Clock out of sync")
+	}
+
+	secret, err := curve25519.X25519(priv, c[:32])
+	if err != nil {
+		return err
+	}
+	c2s, s2c := SessionKeys(secret, pub, c[:32], e.keyring)
+	return e.setup(s2c, c2s)
+}
+
+func (e *EncStreamClient) setup(rKey, sKey *[32]byte) (err error) {
+	if e.rAEAD, err = NewAEAD(e.opts.Cipher, rKey); err != nil {
+		return err
+	}
+	if e.sAEAD, err = NewAEAD(e.opts.Cipher, sKey); err != nil {
+		return err
+	}
+	e.rNonce = make([]byte, e.rAEAD.NonceSize())
+	e.sNonce = make([]byte, e.sAEAD.NonceSize())
+	e.lBuf = make([]byte, 2+e.rAEAD.Overhead())
+	e.lPlain = make([]byte, 0, 2)
+	return nil
 }
 
 func (e *EncStreamClient) Read(b []byte) (int, error) {
 	if len(e.rBuf) > 0 {
 		n := copy(b, e.rBuf)
 		e.rBuf = e.rBuf[n:]
+		if len(e.rBuf) == 0 {
+			e.release()
+		}
 		return n, nil
 	}
 
-	if n, err := io.ReadFull(e.Conn, e.dBuf); err != nil || n != 8 {
+	if err := e.Handshake(); err != nil {
+		return 0, err
+	}
+
+	p, err := e.readFrame()
+	if err != nil {
 		return 0, err
 	}
 
-	size, ok := ClientDecode(e.dBuf, e.keyring)
-	if !ok {
+	n := copy(b, p)
+	if n < len(p) {
+		e.rBuf = p[n:]
+	} else {
+		e.release()
+	}
+
+	return n, nil
+}
+
+func (e *EncStreamClient) release() {
+	if e.pBuf != nil {
+		e.opts.putBuf(e.pBuf)
+		e.pBuf = nil
+	}
+}
+
+func (e *EncStreamClient) readFrame() ([]byte, error) {
+	if _, err := io.ReadFull(e.Conn, e.lBuf); err != nil {
+		return nil, err
+	}
+
+	l, err := e.rAEAD.Open(e.lPlain, e.rNonce, e.lBuf, nil)
+	if err != nil {
 		log.Println("INVALID PACKET RECEIVED")
-		return 0, errors.New("Decode failed")
+		return nil, err
 	}
+	increment(e.rNonce)
 
-	c := make([]byte, size)
+	size := int(binary.BigEndian.Uint16(l))
+	if size > e.opts.maxFrame() {
+		log.Printf("FRAME TOO LARGE: %d", size)
+		_, err := e.Drop()
+		return nil, err
+	}
+
+	e.pBuf = e.opts.getBuf()
+	half := len(*e.pBuf) / 2
+	c := (*e.pBuf)[:size+e.rAEAD.Overhead()]
 	if _, err := io.ReadFull(e.Conn, c); err != nil {
 		log.Printf("%v", err)
-		return 0, err
+		e.release()
+		return nil, err
 	}
 
-	p, ok := secretbox.Open(nil, c[:size], &e.rNonce, e.keyring.k_cipher)
-	if !ok {
-		return 0, errors.New("Decryption Failed")
+	p, err := e.rAEAD.Open((*e.pBuf)[half:half], e.rNonce, c, nil)
+	if err != nil {
+		e.release()
+		return nil, err
 	}
-	increment(&e.rNonce)
+	increment(e.rNonce)
 
-	n := copy(b, p)
-	if n < len(p) {
-		e.rBuf = p[n:]
+	if len(p) < 2 || int(binary.BigEndian.Uint16(p)) > len(p)-2 {
+		log.Println("INVALID FRAME PADDING")
+		e.release()
+		return nil, errors.New("Invalid padding")
 	}
-
-	return n, nil
+	return p[2 : 2+int(binary.BigEndian.Uint16(p))], nil
 }
 
 func (e *EncStreamClient) Write(b []byte) (int, error) {
+	if err := e.Handshake(); err != nil {
+		return 0, err
+	}
+
 	sidx, eidx, chnk := 0, 0, Chunk()
+	if chnk > e.opts.maxFrame()-2 {
+		chnk = e.opts.maxFrame() - 2
+	}
+	if chnk <= 0 {
+		return 0, errors.New("Max frame too small")
+	}
 	for ; sidx < len(b); sidx = eidx {
 		if len(b)-eidx >= chnk {
 			eidx += chnk
 		} else {
 			eidx = len(b)
 		}
-		cipher := secretbox.Seal([]byte{}, b[sidx:eidx], &e.sNonce, e.keyring.k_cipher)
-		increment(&e.sNonce)
-
-		enc_header := ClientEncode(len(cipher), e.keyring)
-		enc_buf := make([]byte, len(enc_header) + len(cipher))
-		
-		copy(enc_buf[:len(enc_header)], enc_header)
-		copy(enc_buf[len(enc_header):], cipher)
-
-		if _, err := e.Conn.Write(enc_buf); err != nil {
+		if _, err := e.Conn.Write(e.seal(b[sidx:eidx])); err != nil {
 			return sidx, err
 		}
 	}
 	return sidx, nil
 }
 
+func (e *EncStreamClient) seal(b []byte) []byte {
+	frame := make([]byte, 2+len(b)+e.opts.Padding.Size(len(b), e.opts.maxFrame()))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	l := make([]byte, 2)
+	binary.BigEndian.PutUint16(l, uint16(len(frame)))
+
+	enc_buf := make([]byte, 0, len(l)+len(frame)+2*e.sAEAD.Overhead())
+	enc_buf = e.sAEAD.Seal(enc_buf, e.sNonce, l, nil)
+	increment(e.sNonce)
+	enc_buf = e.sAEAD.Seal(enc_buf, e.sNonce, frame, nil)
+	increment(e.sNonce)
+	return enc_buf
+}
+
 func (e *EncStreamClient) Close() error {
 	return e.Conn.Close()
 }
@@ -135,7 +344,33 @@ func (e *EncStreamClient) Drop() (int, error) {
 	return 0, errors.New("ILLEGAL CONNECTION CLOSED")
 }
 
-func ClientEncode(i int, keys *Keyring) []byte {
+func Ephemeral() ([]byte, []byte, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	return priv, pub, err
+}
+
+func HelloMAC(keys *Keyring, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, keys.k_auth)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)[:16]
+}
+
+func SessionKeys(secret, cPub, sPub []byte, keys *Keyring) (*[32]byte, *[32]byte) {
+	info := append([]byte(Version), cPub...)
+	r := hkdf.New(sha256.New, secret, keys.k_cipher[:], append(info, sPub...))
+	var c2s, s2c [32]byte
+	io.ReadFull(r, c2s[:])
+	io.ReadFull(r, s2c[:])
+	return &c2s, &s2c
+}
+
+func ClientEncode(i int, keys *Keyring, offset int64) []byte {
 	head := make([]byte, 16)
 	iBuf := make([]byte, 4)
 	hBuf := make([]byte, 36)
@@ -143,7 +378,7 @@ func ClientEncode(i int, keys *Keyring) []byte {
 	rand.Read(head[:4])
 	copy(hBuf[:4], head[:4])
 
-	t := time.Now().Unix()
+	t := time.Now().Unix() + offset
 	binary.LittleEndian.PutUint32(iBuf, uint32(t))
 	copy(hBuf[4:], keys.k_timestamp)
 	copy(head[4:8], XORBytes(iBuf, SH256S(hBuf)))
@@ -179,7 +414,7 @@ func XORBytes(a, b []byte) []byte {
 	return buf
 }
 
-func increment(b *[24]byte) {
+func increment(b []byte) {
 	for i := range b {
 		b[i]++
 		if b[i] != 0 {
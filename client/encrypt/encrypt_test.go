@@ -0,0 +1,55 @@
+package encrypt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	server "../../server/encrypt"
+)
+
+// recorder keeps a copy of everything written to the wire.
+type recorder struct {
+	net.Conn
+	wire bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.wire.Write(b)
+	return r.Conn.Write(b)
+}
+
+// session runs one tunnel over a pipe and returns the frames the client put on the wire after its hello.
+func session(t *testing.T, psk string, msg []byte) []byte {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	rec := &recorder{Conn: a}
+	c := NewEncStreamClient(rec, NewKeyring(psk), &Options{})
+	s := server.NewEncStreamServer(b, []*server.Keyring{server.NewKeyring(psk)}, &server.Options{})
+	go c.Write(msg)
+
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("plaintext mismatch")
+	}
+	return append([]byte(nil), rec.wire.Bytes()[16+HelloLen:]...)
+}
+
+func TestSessionCiphertextsDiffer(t *testing.T) {
+	msg := bytes.Repeat([]byte("torii"), 1000)
+	first := session(t, "psk", msg)
+	second := session(t, "psk", msg)
+	if bytes.Equal(first, second) {
+		t.Fatal("identical ciphertexts across sessions")
+	}
+	// The first frame is sealed under the first nonce of each session; it must differ too.
+	if bytes.Equal(first[:64], second[:64]) {
+		t.Fatal("sessions share a ciphertext prefix")
+	}
+}
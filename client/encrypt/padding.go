@@ -0,0 +1,89 @@
+package encrypt
+
+import (
+	"errors"
+	mr "math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var DefaultBuckets = []int{128, 256, 512, 1024, 2048, 4096, 8192, 16384}
+
+// Padding decides how many random bytes are appended inside each sealed frame.
+type Padding struct {
+	Mode     string
+	Min, Max int
+	Buckets  []int
+}
+
+// ParsePadding accepts "none", "random[:min-max]" or "bucket[:size,size,...]".
+func ParsePadding(s string) (*Padding, error) {
+	mode, arg := s, ""
+	if i := strings.IndexByte(s, ':'); i != -1 {
+		mode, arg = s[:i], s[i+1:]
+	}
+
+	switch mode {
+	case "", "none":
+		return &Padding{Mode: "none"}, nil
+	case "random":
+		p := &Padding{Mode: mode, Min: 0, Max: 255}
+		if arg != "" {
+			r := strings.SplitN(arg, "-", 2)
+			if len(r) != 2 {
+				return nil, errors.New("Invalid padding range " + arg)
+			}
+			min, err1 := strconv.Atoi(r[0])
+			max, err2 := strconv.Atoi(r[1])
+			if err1 != nil || err2 != nil || min < 0 || max < min {
+				return nil, errors.New("Invalid padding range " + arg)
+			}
+			p.Min, p.Max = min, max
+		}
+		return p, nil
+	case "bucket":
+		p := &Padding{Mode: mode, Buckets: DefaultBuckets}
+		if arg != "" {
+			p.Buckets = nil
+			for _, f := range strings.Split(arg, ",") {
+				b, err := strconv.Atoi(f)
+				if err != nil || b <= 0 {
+					return nil, errors.New("Invalid padding bucket " + f)
+				}
+				p.Buckets = append(p.Buckets, b)
+			}
+			sort.Ints(p.Buckets)
+		}
+		return p, nil
+	}
+	return nil, errors.New("Unsupported padding " + mode)
+}
+
+// Size returns the padding for a frame carrying n bytes, keeping the frame within limit.
+func (p *Padding) Size(n, limit int) int {
+	if p == nil {
+		return 0
+	}
+
+	pad := 0
+	switch p.Mode {
+	case "random":
+		pad = p.Min + mr.Intn(p.Max-p.Min+1)
+	case "bucket":
+		for _, b := range p.Buckets {
+			if b >= n+2 {
+				pad = b - n - 2
+				break
+			}
+		}
+	}
+
+	if pad > limit-n-2 {
+		pad = limit - n - 2
+	}
+	if pad < 0 {
+		return 0
+	}
+	return pad
+}
@@ -4,24 +4,30 @@ import (
 	"./compress"
 	"./config"
 	"./encrypt"
+	"./mux"
+	"./pool"
 	"./proxy"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 func main() {
 	client := struct {
-		conf *config.Client
-		wg   sync.WaitGroup
+		conf   *config.Client
+		tunnel proxy.Dialer
+		wg     sync.WaitGroup
 	}{
 		conf: config.LoadClientConf(),
 		wg:   sync.WaitGroup{},
 	}
+	ttl := time.Duration(client.conf.Poolttl) * time.Second
 
 	if len(client.conf.Tcpserver)*len(client.conf.Tcpclient) > 0 {
 		tcp := initAddr("TCP", client.conf.Tcpclient)
 		defer tcp.Close()
+		warm := pool.NewPool("TCP", client.conf.Pool, ttl, dialer(client.conf.Tcpserver, client.conf))
 		client.wg.Add(1)
 		go func() {
 			defer client.wg.Done()
@@ -31,16 +37,31 @@ func main() {
 					log.Printf("FAILED TO ACCEPT TCP CONNECTION: %v", err)
 					continue
 				}
-				dst, err := net.Dial("tcp", client.conf.Tcpserver)
-				if err != nil {
-					log.Println("TCP SERVER UNREACHABLE")
-					continue
-				}
-				go forward(src, dst, client.conf)
+				go func() {
+					dst, err := warm.Get()
+					if err != nil {
+						log.Println("TCP SERVER UNREACHABLE: ", err)
+						src.Close()
+						return
+					}
+					forward(src, dst, client.conf)
+				}()
 			}
 		}()
 	}
 
+	if len(client.conf.Socksserver) > 0 {
+		warm := pool.NewPool("SOCKS", client.conf.Pool, ttl, dialer(client.conf.Socksserver, client.conf))
+		client.tunnel = compressed(warm.Get, client.conf)
+		if client.conf.Mux {
+			streams := mux.NewPool(client.conf.Muxconns, warm.Get)
+			client.tunnel = compressed(func() (net.Conn, error) {
+				return streams.Open()
+			}, client.conf)
+			log.Printf("MULTIPLEXING SOCKS CONNECTIONS OVER %d TUNNELS", client.conf.Muxconns)
+		}
+	}
+
 	if len(client.conf.Socksserver)*len(client.conf.Socksclient) > 0 {
 		socks := initAddr("SOCKS CLIENT", client.conf.Socksclient)
 		defer socks.Close()
@@ -53,12 +74,70 @@ func main() {
 					log.Println("FAILED TO ACCEPT SOCKS CONNECTION: ", err)
 					continue
 				}
-				dst, err := net.Dial("tcp", client.conf.Socksserver)
+				go proxy.NewProxyClient(src, client.conf.Getauth(), client.conf.Getrouter()).Connect(client.tunnel)
+			}
+		}()
+	}
+
+	if len(client.conf.Socksserver)*len(client.conf.Httpclient) > 0 {
+		web := initAddr("HTTP CLIENT", client.conf.Httpclient)
+		defer web.Close()
+		client.wg.Add(1)
+		go func() {
+			defer client.wg.Done()
+			for {
+				src, err := web.Accept()
 				if err != nil {
-					log.Println("SOCKS SERVER UNREACHABLE: ", err)
+					log.Println("FAILED TO ACCEPT HTTP CONNECTION: ", err)
 					continue
 				}
-				go socks5(dst, src, client.conf)
+				go proxy.NewHTTPClient(src, client.conf.Getauth(), client.conf.Getrouter()).Connect(client.tunnel)
+			}
+		}()
+	}
+
+	if len(client.conf.Socksserver)*len(client.conf.Mixedclient) > 0 {
+		mixed := initAddr("MIXED CLIENT", client.conf.Mixedclient)
+		defer mixed.Close()
+		client.wg.Add(1)
+		go func() {
+			defer client.wg.Done()
+			for {
+				src, err := mixed.Accept()
+				if err != nil {
+					log.Println("FAILED TO ACCEPT MIXED CONNECTION: ", err)
+					continue
+				}
+				go func() {
+					conn, socks, err := proxy.Sniff(src)
+					if err != nil {
+						src.Close()
+						return
+					}
+					if socks {
+						proxy.NewProxyClient(conn, client.conf.Getauth(), client.conf.Getrouter()).Connect(client.tunnel)
+					} else {
+						proxy.NewHTTPClient(conn, client.conf.Getauth(), client.conf.Getrouter()).Connect(client.tunnel)
+					}
+				}()
+			}
+		}()
+	}
+
+	if len(client.conf.Socksserver)*len(client.conf.Redirclient) > 0 {
+		tproxy := client.conf.Redirmode == "tproxy"
+		redir := initRedir(client.conf.Redirclient, tproxy)
+		defer redir.Close()
+		client.wg.Add(1)
+		go func() {
+			defer client.wg.Done()
+			for {
+				src, err := redir.Accept()
+				if err != nil {
+					log.Println("FAILED TO ACCEPT REDIRECTED CONNECTION: ", err)
+					continue
+				}
+				go proxy.NewRedirClient(src, tproxy, client.conf.Getrouter()).Connect(client.tunnel)
 			}
 		}()
 	}
@@ -75,30 +154,62 @@ func initAddr(name, addr string) net.Listener {
 	return listener
 }
 
-func socks5(server, client net.Conn, conf *config.Client) {
-	eStream := encrypt.NewEncStreamClient(server, conf.Getkeyring())
-	switch conf.Compression {
-	case "snappy":
-		cStream := compress.NewSnappyStream(eStream)
-		proxy.NewProxyClient(client).Connect(cStream)
-	case "brotli":
-		cStream := compress.NewBrotliStream(eStream)
-		proxy.NewProxyClient(client).Connect(cStream)
-	default:
-		proxy.NewProxyClient(client).Connect(eStream)
+func initRedir(addr string, tproxy bool) net.Listener {
+	listen, name := proxy.ListenRedirect, "REDIRECT"
+	if tproxy {
+		listen, name = proxy.ListenTProxy, "TPROXY"
+	}
+	defer log.Printf("%s CLIENT LISTENER STARTED AT %s", name, addr)
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatalln("LISTENER FAILED TO START: ", err)
+	}
+	return listener
+}
+
+// compressed wraps connections from open with the configured compression.
+func compressed(open func() (net.Conn, error), conf *config.Client) proxy.Dialer {
+	return func() (net.Conn, error) {
+		conn, err := open()
+		if err != nil {
+			return nil, err
+		}
+		switch conf.Compression {
+		case "snappy":
+			return compress.NewSnappyStream(conn), nil
+		case "brotli":
+			return compress.NewBrotliStream(conn), nil
+		default:
+			return conn, nil
+		}
 	}
 }
 
 func forward(src, dst net.Conn, conf *config.Client) {
-	eStream := encrypt.NewEncStreamClient(dst, conf.Getkeyring())
 	switch conf.Compression {
 	case "snappy":
-		cStream := compress.NewSnappyStreamClient(eStream)
+		cStream := compress.NewSnappyStreamClient(dst)
 		proxy.Pipe(src, cStream)
 	case "brotli":
-		cStream := compress.NewBrotliStream(eStream)
+		cStream := compress.NewBrotliStream(dst)
 		proxy.Pipe(src, cStream)
 	default:
-		proxy.Pipe(src, eStream)
+		proxy.Pipe(src, dst)
+	}
+}
+
+// dialer connects and authenticates to addr, so pooled connections are ready to carry data.
+func dialer(addr string, conf *config.Client) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		eStream := encrypt.NewEncStreamClient(conn, conf.Getkeyring(), conf.Getoptions())
+		if err := eStream.Handshake(); err != nil {
+			eStream.Close()
+			return nil, err
+		}
+		return eStream, nil
 	}
 }
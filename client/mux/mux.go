@@ -0,0 +1,397 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	cmdSYN byte = iota
+	cmdFIN
+	cmdPSH
+	cmdUPD
+	cmdNOP
+)
+
+const (
+	headerSize int = 7
+	FrameSize  int = 16384
+	Window     int = 256 * 1024
+	KeepAlive      = 10 * time.Second
+	Timeout        = 30 * time.Second
+)
+
+var (
+	ErrClosed  = errors.New("Mux session closed")
+	ErrTimeout = errors.New("Mux stream i/o timeout")
+)
+
+// Session multiplexes streams over one connection.
+// Frame layout: cmd(1) | stream id(4) | length(2) | data
+type Session struct {
+	conn     net.Conn
+	mu       sync.Mutex
+	wmu      sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	accept   chan *Stream
+	die      chan struct{}
+	dieOnce  sync.Once
+	lastRecv time.Time
+}
+
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1)
+}
+
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 0)
+}
+
+func newSession(conn net.Conn, id uint32) *Session {
+	s := &Session{
+		conn:     conn,
+		streams:  make(map[uint32]*Stream),
+		nextID:   id,
+		accept:   make(chan *Stream, 1024),
+		die:      make(chan struct{}),
+		lastRecv: time.Now(),
+	}
+	go s.recvLoop()
+	go s.keepAlive()
+	return s
+}
+
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(id, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, nil); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.die:
+		return nil, ErrClosed
+	}
+}
+
+func (s *Session) Close() error {
+	s.dieOnce.Do(func() {
+		close(s.die)
+		s.conn.Close()
+	})
+	return nil
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) recvLoop() {
+	defer s.Close()
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return
+		}
+		cmd, id, size := header[0], binary.BigEndian.Uint32(header[1:5]), int(binary.BigEndian.Uint16(header[5:7]))
+		data := make([]byte, size)
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.lastRecv = time.Now()
+		st := s.streams[id]
+		if cmd == cmdSYN && st == nil {
+			st = newStream(id, s)
+			s.streams[id] = st
+		}
+		s.mu.Unlock()
+
+		switch cmd {
+		case cmdSYN:
+			select {
+			case s.accept <- st:
+			case <-s.die:
+				return
+			}
+		case cmdPSH:
+			if st != nil {
+				st.push(data)
+			}
+		case cmdUPD:
+			if st != nil && size == 4 {
+				st.credit(int(binary.BigEndian.Uint32(data)))
+			}
+		case cmdFIN:
+			if st != nil {
+				st.fin()
+			}
+		case cmdNOP:
+		default:
+			log.Printf("UNKNOWN MUX COMMAND: %d", cmd)
+			return
+		}
+	}
+}
+
+func (s *Session) keepAlive() {
+	t := time.NewTicker(KeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			idle := time.Since(s.lastRecv)
+			s.mu.Unlock()
+			if idle > Timeout {
+				log.Println("MUX SESSION TIMED OUT")
+				s.Close()
+				return
+			}
+			s.writeFrame(cmdNOP, 0, nil)
+		case <-s.die:
+			return
+		}
+	}
+}
+
+func (s *Session) writeFrame(cmd byte, id uint32, data []byte) error {
+	buf := make([]byte, headerSize+len(data))
+	buf[0] = cmd
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint16(buf[5:7], uint16(len(data)))
+	copy(buf[headerSize:], data)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.IsClosed() {
+		return ErrClosed
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// Stream is a logical connection inside a session with its own flow control window.
+type Stream struct {
+	id        uint32
+	sess      *Session
+	mu        sync.Mutex
+	buf       []byte
+	consumed  int
+	window    int
+	finRecv   bool
+	readable  chan struct{}
+	writable  chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	rDeadline time.Time
+	wDeadline time.Time
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:       id,
+		sess:     sess,
+		window:   Window,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.buf) > 0 {
+			n := copy(b, st.buf)
+			st.buf = st.buf[n:]
+			st.consumed += n
+			update := 0
+			if st.consumed >= Window/4 {
+				update, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+
+			if update > 0 {
+				u := make([]byte, 4)
+				binary.BigEndian.PutUint32(u, uint32(update))
+				st.sess.writeFrame(cmdUPD, st.id, u)
+			}
+			return n, nil
+		}
+		fin, deadline := st.finRecv, st.rDeadline
+		st.mu.Unlock()
+
+		if fin {
+			return 0, io.EOF
+		}
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		st.mu.Lock()
+		if st.finRecv {
+			st.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		size, deadline := st.window, st.wDeadline
+		if size > len(b)-n {
+			size = len(b) - n
+		}
+		if size > FrameSize {
+			size = FrameSize
+		}
+		st.window -= size
+		st.mu.Unlock()
+
+		if size <= 0 {
+			if err := st.wait(st.writable, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if err := st.sess.writeFrame(cmdPSH, st.id, b[n:n+size]); err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return ErrTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-st.closed:
+		return io.ErrClosedPipe
+	case <-st.sess.die:
+		return ErrClosed
+	case <-timeout:
+		return ErrTimeout
+	}
+}
+
+func (st *Stream) push(data []byte) {
+	st.mu.Lock()
+	st.buf = append(st.buf, data...)
+	st.mu.Unlock()
+	notify(st.readable)
+}
+
+func (st *Stream) credit(n int) {
+	st.mu.Lock()
+	st.window += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+func (st *Stream) fin() {
+	st.mu.Lock()
+	st.finRecv = true
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func (st *Stream) Close() error {
+	st.closeOnce.Do(func() {
+		close(st.closed)
+		st.sess.remove(st.id)
+		st.sess.writeFrame(cmdFIN, st.id, nil)
+	})
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.wDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
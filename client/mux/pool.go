@@ -0,0 +1,51 @@
+package mux
+
+import (
+	"net"
+	"sync"
+)
+
+const PoolSize int = 4
+
+// Pool spreads streams over a fixed number of sessions and redials dead ones on demand.
+type Pool struct {
+	dial     func() (net.Conn, error)
+	mu       sync.Mutex
+	sessions []*Session
+}
+
+func NewPool(size int, dial func() (net.Conn, error)) *Pool {
+	if size <= 0 {
+		size = PoolSize
+	}
+	return &Pool{
+		dial:     dial,
+		sessions: make([]*Session, size),
+	}
+}
+
+func (p *Pool) Open() (*Stream, error) {
+	p.mu.Lock()
+	slot, load := -1, 0
+	for i, s := range p.sessions {
+		if s == nil || s.IsClosed() {
+			slot = i
+			break
+		}
+		if n := s.NumStreams(); slot == -1 || n < load {
+			slot, load = i, n
+		}
+	}
+	s := p.sessions[slot]
+	if s == nil || s.IsClosed() {
+		conn, err := p.dial()
+		if err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		s = Client(conn)
+		p.sessions[slot] = s
+	}
+	p.mu.Unlock()
+	return s.Open()
+}
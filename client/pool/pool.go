@@ -0,0 +1,72 @@
+package pool
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	TTL     int = 60
+	Backoff     = time.Second
+	MaxWait     = 30 * time.Second
+)
+
+// Pool keeps a number of connections dialed in advance. Each one is handed out
+// at most once and replaced when it has been idle for longer than ttl.
+type Pool struct {
+	name  string
+	dial  func() (net.Conn, error)
+	ttl   time.Duration
+	conns chan net.Conn
+}
+
+func NewPool(name string, size int, ttl time.Duration, dial func() (net.Conn, error)) *Pool {
+	p := &Pool{
+		name:  name,
+		dial:  dial,
+		ttl:   ttl,
+		conns: make(chan net.Conn),
+	}
+	for i := 0; i < size; i++ {
+		go p.fill()
+	}
+	if size > 0 {
+		log.Printf("%s POOL STARTED WITH %d CONNECTIONS", name, size)
+	}
+	return p
+}
+
+// Get returns a warm connection if one is ready, otherwise dials a new one.
+func (p *Pool) Get() (net.Conn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	default:
+		return p.dial()
+	}
+}
+
+func (p *Pool) fill() {
+	wait := Backoff
+	for {
+		conn, err := p.dial()
+		if err != nil {
+			log.Printf("%s POOL DIAL FAILED: %v", p.name, err)
+			time.Sleep(wait)
+			if wait *= 2; wait > MaxWait {
+				wait = MaxWait
+			}
+			continue
+		}
+		wait = Backoff
+
+		stale := time.NewTimer(p.ttl)
+		select {
+		case p.conns <- conn:
+			stale.Stop()
+		case <-stale.C:
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+)
+
+const (
+	methodNoAuth   byte = 0x00
+	methodPassword byte = 0x02
+	methodNone     byte = 0xff
+)
+
+var (
+	errMethod = errors.New("No acceptable authentication method")
+	errAuth   = errors.New("Authentication failed")
+)
+
+// Auth holds the credentials required from local clients, nil means no authentication.
+type Auth struct {
+	User string
+	Pass string
+}
+
+func (a *Auth) Check(user, pass string) bool {
+	u := subtle.ConstantTimeCompare([]byte(user), []byte(a.User))
+	p := subtle.ConstantTimeCompare([]byte(pass), []byte(a.Pass))
+	return u&p == 1
+}
+
+// negotiate reads the method list after the version byte, selects one and runs the RFC 1929 sub-negotiation when required.
+func (p *ProxyClient) negotiate() error {
+	if _, err := io.ReadFull(p.Conn, p.rBuf[1:2]); err != nil {
+		return err
+	}
+	methods := make([]byte, p.rBuf[1])
+	if _, err := io.ReadFull(p.Conn, methods); err != nil {
+		return err
+	}
+
+	want := methodNoAuth
+	if p.auth != nil {
+		want = methodPassword
+	}
+	selected := methodNone
+	for _, m := range methods {
+		if m == want {
+			selected = m
+		}
+	}
+	if _, err := p.Conn.Write([]byte{0x05, selected}); err != nil {
+		return err
+	}
+	if selected == methodNone {
+		return errMethod
+	}
+	if selected == methodNoAuth {
+		return nil
+	}
+
+	// ver | ulen | uname | plen | passwd
+	if _, err := io.ReadFull(p.Conn, p.rBuf[:2]); err != nil {
+		return err
+	}
+	user := make([]byte, p.rBuf[1])
+	if _, err := io.ReadFull(p.Conn, user); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(p.Conn, p.rBuf[:1]); err != nil {
+		return err
+	}
+	pass := make([]byte, p.rBuf[0])
+	if _, err := io.ReadFull(p.Conn, pass); err != nil {
+		return err
+	}
+
+	if !p.auth.Check(string(user), string(pass)) {
+		p.Conn.Write([]byte{0x01, 0x01})
+		return errAuth
+	}
+	_, err := p.Conn.Write([]byte{0x01, 0x00})
+	return err
+}
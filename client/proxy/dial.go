@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"../route"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Dialer opens a new connection to the server carrying a single tunnel request.
+type Dialer func() (net.Conn, error)
+
+// open connects to addr (wire form) directly, through a new tunnel or not at all, as decided by router.
+// It returns the connection together with the reply code and bound address for the local client.
+func open(dial Dialer, router *route.Router, addr []byte) (net.Conn, byte, []byte) {
+	host, port := parseAddr(addr)
+	switch router.Match(host, port) {
+	case route.Block:
+		return nil, repNotAllowed, nil
+	case route.Direct:
+		dst, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), time.Second*15)
+		if err != nil {
+			log.Printf("UNABLE TO CONNECT DIRECTLY: %s, %v", host, err)
+			return nil, replyCode(err), nil
+		}
+		local := dst.LocalAddr().(*net.TCPAddr)
+		return dst, repSucceeded, encodeAddr(local.IP, local.Port)
+	}
+
+	src, err := dial()
+	if err != nil {
+		log.Println("SOCKS SERVER UNREACHABLE: ", err)
+		return nil, repFailure, nil
+	}
+	if _, err := src.Write(append([]byte{cmdConnect}, addr...)); err != nil {
+		log.Printf("UNABLE TO SEND REQUEST: %v", err)
+		src.Close()
+		return nil, repFailure, nil
+	}
+	rep, bind, err := readReply(src)
+	if err != nil {
+		log.Printf("UNABLE TO GET SERVER RESPONSE: %v", err)
+		rep = repFailure
+	}
+	if rep != repSucceeded {
+		src.Close()
+		return nil, rep, nil
+	}
+	return src, rep, bind
+}
+
+// parseAddr splits a wire address into host and port.
+func parseAddr(addr []byte) (string, int) {
+	port := int(binary.BigEndian.Uint16(addr[len(addr)-2:]))
+	if addr[0] == atypDomain {
+		return string(addr[2 : len(addr)-2]), port
+	}
+	return net.IP(addr[1 : len(addr)-2]).String(), port
+}
+
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return repHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return repRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return repNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return repHostUnreachable
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return repTTLExpired
+	}
+	return repFailure
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"../route"
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type HTTPClient struct {
+	r      *bufio.Reader
+	auth   *Auth
+	router *route.Router
+	net.Conn
+}
+
+func NewHTTPClient(conn net.Conn, auth *Auth, router *route.Router) *HTTPClient {
+	return &HTTPClient{
+		Conn:   conn,
+		auth:   auth,
+		router: router,
+		r:      bufio.NewReader(conn),
+	}
+}
+
+// Read drains bytes buffered while parsing the request before reading the connection.
+func (h *HTTPClient) Read(b []byte) (int, error) {
+	return h.r.Read(b)
+}
+
+// Connect handles one CONNECT or absolute-URI request.
+// Plain requests are sent with Connection: close, so each client connection carries one of them.
+func (h *HTTPClient) Connect(dial Dialer) {
+	req, err := http.ReadRequest(h.r)
+	if err != nil {
+		log.Printf("UNABLE TO GET HTTP REQUEST: %v", err)
+		defer h.Conn.Close()
+		return
+	}
+
+	if h.auth != nil && !h.authorized(req) {
+		h.status(http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"torii\"\r\n")
+		defer h.Conn.Close()
+		return
+	}
+
+	host := req.Host
+	if req.Method != http.MethodConnect {
+		if req.URL.Scheme != "http" || len(req.URL.Host) == 0 {
+			h.status(http.StatusBadRequest, "")
+			defer h.Conn.Close()
+			return
+		}
+		host = req.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "80")
+	}
+
+	addr, err := wireAddr(host)
+	if err != nil {
+		log.Printf("ILLEGAL DST: %s, %v", host, err)
+		h.status(http.StatusBadRequest, "")
+		defer h.Conn.Close()
+		return
+	}
+
+	dst, rep, _ := open(dial, h.router, addr)
+	if rep != repSucceeded {
+		h.status(httpStatus(rep), "")
+		defer h.Conn.Close()
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		err = h.status(http.StatusOK, "")
+	} else {
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Proxy-Connection")
+		req.Close = true
+		err = req.Write(dst)
+	}
+	if err != nil {
+		log.Printf("UNABLE TO WRITE REQUEST: %v", err)
+		defer h.Conn.Close()
+		defer dst.Close()
+		return
+	}
+
+	Pipe(h, dst)
+}
+
+func (h *HTTPClient) authorized(req *http.Request) bool {
+	const prefix = "Basic "
+	v := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(v, prefix) {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(v[len(prefix):])
+	if err != nil {
+		return false
+	}
+	i := strings.IndexByte(string(b), ':')
+	if i == -1 {
+		return false
+	}
+	return h.auth.Check(string(b[:i]), string(b[i+1:]))
+}
+
+func (h *HTTPClient) status(code int, header string) error {
+	if code != http.StatusOK {
+		header += "Content-Length: 0\r\nConnection: close\r\n"
+	}
+	_, err := fmt.Fprintf(h.Conn, "HTTP/1.1 %d %s\r\n%s\r\n", code, http.StatusText(code), header)
+	return err
+}
+
+func httpStatus(rep byte) int {
+	switch rep {
+	case repNotAllowed:
+		return http.StatusForbidden
+	case repTTLExpired:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// wireAddr converts host:port to wire form: atyp | addr | port
+func wireAddr(hostport string) ([]byte, error) {
+	host, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("Invalid port: %s", p)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return encodeAddr(ip, port), nil
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf("Invalid host: %s", host)
+	}
+	buf := append([]byte{atypDomain, byte(len(host))}, host...)
+	return append(buf, byte(port>>8), byte(port)), nil
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+)
+
+type peekConn struct {
+	r *bufio.Reader
+	net.Conn
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Sniff peeks at the first byte of conn and reports whether it starts a SOCKS4/4a/5 request,
+// otherwise it is treated as HTTP. The returned connection still yields the peeked byte.
+func Sniff(conn net.Conn) (net.Conn, bool, error) {
+	r := bufio.NewReader(conn)
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, false, err
+	}
+	return &peekConn{r: r, Conn: conn}, b[0] == 0x04 || b[0] == 0x05, nil
+}
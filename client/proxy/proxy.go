@@ -1,34 +1,77 @@
 package proxy
 
 import (
+	"../route"
+	"errors"
 	"io"
 	"log"
 	"net"
 )
 
+const (
+	atypIPv4   byte = 0x01
+	atypDomain byte = 0x03
+	atypIPv6   byte = 0x04
+)
+
 var res = []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 
+const (
+	cmdConnect byte = 0x01
+	cmdBind    byte = 0x02
+	cmdUDP     byte = 0x03
+)
+
+const (
+	repSucceeded       byte = 0x00
+	repFailure         byte = 0x01
+	repNotAllowed      byte = 0x02
+	repNetUnreachable  byte = 0x03
+	repHostUnreachable byte = 0x04
+	repRefused         byte = 0x05
+	repTTLExpired      byte = 0x06
+	repCmdUnsupported  byte = 0x07
+	repAtypUnsupported byte = 0x08
+)
+
+var errAtyp = errors.New("Unsupported ATYP")
+
 type ProxyClient struct {
-	rBuf []byte
+	rBuf   []byte
+	auth   *Auth
+	router *route.Router
 	net.Conn
 }
 
-func NewProxyClient(conn net.Conn) *ProxyClient {
+func NewProxyClient(conn net.Conn, auth *Auth, router *route.Router) *ProxyClient {
 	return &ProxyClient{
-		Conn: conn,
-		rBuf: make([]byte, 4),
+		Conn:   conn,
+		auth:   auth,
+		router: router,
+		rBuf:   make([]byte, 4),
 	}
 }
 
-func (p *ProxyClient) Connect(src net.Conn) {
-	if n, err := io.ReadFull(p.Conn, p.rBuf[:3]); err != nil || n != 3 {
+func (p *ProxyClient) Connect(dial Dialer) {
+	if _, err := io.ReadFull(p.Conn, p.rBuf[:1]); err != nil {
 		log.Printf("UNABLE TO GET SOCKS VERSION: %v", err)
 		defer p.Conn.Close()
 		return
 	}
 
-	if n, err := p.Conn.Write(res[:2]); err != nil || n != 2 {
-		log.Printf("UNABLE TO SEND RESPONSE: %v", err)
+	switch p.rBuf[0] {
+	case 0x04:
+		p.socks4(dial)
+		return
+	case 0x05:
+	default:
+		log.Printf("UNSUPPORTED SOCKS VERSION: %d", p.rBuf[0])
+		defer p.Conn.Close()
+		return
+	}
+
+	if err := p.negotiate(); err != nil {
+		log.Printf("SOCKS NEGOTIATION FAILED: %s, %v", p.Conn.RemoteAddr(), err)
 		defer p.Conn.Close()
 		return
 	}
@@ -39,21 +82,147 @@ func (p *ProxyClient) Connect(src net.Conn) {
 		return
 	}
 
-	if p.rBuf[3] != 0x03 {
-		log.Printf("UNSUPPORTED ATYP")
+	addr, err := readAddr(p.Conn, p.rBuf[3])
+	if err != nil {
+		log.Printf("UNABLE TO GET DST ADDRESS: %v", err)
+		if err == errAtyp {
+			p.reply(repAtypUnsupported, nil)
+		}
+		defer p.Conn.Close()
+		return
+	}
+
+	switch p.rBuf[1] {
+	case cmdConnect:
+		p.connect(dial, addr)
+	case cmdBind:
+		p.bind(dial, addr)
+	case cmdUDP:
+		p.associate(dial, addr)
+	default:
+		log.Printf("UNSUPPORTED COMMAND: %d", p.rBuf[1])
+		p.reply(repCmdUnsupported, nil)
+		p.Conn.Close()
+	}
+}
+
+func (p *ProxyClient) connect(dial Dialer, addr []byte) {
+	dst, rep, bind := open(dial, p.router, addr)
+	if err := p.reply(rep, bind); err != nil || rep != repSucceeded {
 		defer p.Conn.Close()
+		if dst != nil {
+			defer dst.Close()
+		}
 		return
 	}
 
-	if n, err := p.Conn.Write(res); err != nil || n != 10 {
-		log.Printf("UNABLE TO WRITE RESPONSE: %v", err)
+	Pipe(p.Conn, dst)
+}
+
+// bind relays both BIND replies: the listening address, then the address of the inbound peer.
+func (p *ProxyClient) bind(dial Dialer, addr []byte) {
+	src, err := dial()
+	if err != nil {
+		log.Println("SOCKS SERVER UNREACHABLE: ", err)
+		p.reply(repFailure, nil)
+		p.Conn.Close()
+		return
+	}
+	if _, err := src.Write(append([]byte{cmdBind}, addr...)); err != nil {
+		log.Printf("UNABLE TO SEND REQUEST: %v", err)
+		p.reply(repFailure, nil)
 		defer p.Conn.Close()
+		defer src.Close()
 		return
 	}
-	
+
+	if !p.relayReply(src) || !p.relayReply(src) {
+		defer p.Conn.Close()
+		defer src.Close()
+		return
+	}
+
 	Pipe(p.Conn, src)
 }
 
+// relayReply forwards one server reply to the local client and reports whether it succeeded.
+func (p *ProxyClient) relayReply(src net.Conn) bool {
+	rep, bind, err := readReply(src)
+	if err != nil {
+		log.Printf("UNABLE TO GET SERVER RESPONSE: %v", err)
+		rep, bind = repFailure, nil
+	}
+	if err := p.reply(rep, bind); err != nil {
+		return false
+	}
+	return rep == repSucceeded
+}
+
+// reply sends a SOCKS5 reply with the bound address in wire form, 0.0.0.0:0 when bind is nil.
+func (p *ProxyClient) reply(rep byte, bind []byte) error {
+	buf := make([]byte, 0, 3+len(res))
+	buf = append(buf, 0x05, rep, 0x00)
+	if bind == nil {
+		bind = res[3:]
+	}
+	_, err := p.Conn.Write(append(buf, bind...))
+	return err
+}
+
+// readReply reads the server reply: rep | atyp | addr | port
+func readReply(r io.Reader) (byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, nil, err
+	}
+	bind, err := readAddr(r, head[1])
+	return head[0], bind, err
+}
+
+// readAddr reads a SOCKS5 address of type atyp and returns it in wire form: atyp | addr | port
+func readAddr(r io.Reader, atyp byte) ([]byte, error) {
+	var size int
+	switch atyp {
+	case atypIPv4:
+		size = net.IPv4len
+	case atypIPv6:
+		size = net.IPv6len
+	case atypDomain:
+		size = 1
+	default:
+		return nil, errAtyp
+	}
+
+	buf := make([]byte, 1+size, 1+size+255+2)
+	buf[0] = atyp
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		return nil, err
+	}
+	if atyp == atypDomain {
+		buf = buf[:2+int(buf[1])]
+		if _, err := io.ReadFull(r, buf[2:]); err != nil {
+			return nil, err
+		}
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	return append(buf, port...), nil
+}
+
+// encodeAddr returns ip and port in wire form: atyp | addr | port
+func encodeAddr(ip net.IP, port int) []byte {
+	buf := []byte{atypIPv6}
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append([]byte{atypIPv4}, ip4...)
+	} else {
+		buf = append(buf, ip.To16()...)
+	}
+	return append(buf, byte(port>>8), byte(port))
+}
+
 func Pipe(src, dst net.Conn) {
 	go func() {
 		defer src.Close()
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"../route"
+	"errors"
+	"log"
+	"net"
+)
+
+var errNotRedirected = errors.New("Connection was not redirected")
+
+type RedirClient struct {
+	tproxy bool
+	router *route.Router
+	net.Conn
+}
+
+// NewRedirClient wraps a connection redirected by iptables REDIRECT, or accepted
+// on a TPROXY listener when tproxy is set.
+func NewRedirClient(conn net.Conn, tproxy bool, router *route.Router) *RedirClient {
+	return &RedirClient{
+		Conn:   conn,
+		tproxy: tproxy,
+		router: router,
+	}
+}
+
+// Connect sends the original destination as the tunnel request, there is no negotiation with the local client.
+func (r *RedirClient) Connect(dial Dialer) {
+	dst, err := r.destination()
+	if err != nil {
+		log.Printf("UNABLE TO GET ORIGINAL DST: %s, %v", r.Conn.RemoteAddr(), err)
+		defer r.Conn.Close()
+		return
+	}
+
+	conn, rep, _ := open(dial, r.router, encodeAddr(dst.IP, dst.Port))
+	if rep != repSucceeded {
+		log.Printf("UNABLE TO CONNECT: %s, REP: %d", dst, rep)
+		defer r.Conn.Close()
+		return
+	}
+
+	Pipe(r.Conn, conn)
+}
+
+// TPROXY keeps the original destination as the local address, REDIRECT rewrites it.
+func (r *RedirClient) destination() (*net.TCPAddr, error) {
+	if r.tproxy {
+		return r.Conn.LocalAddr().(*net.TCPAddr), nil
+	}
+	dst, err := originalDst(r.Conn)
+	if err != nil {
+		return nil, err
+	}
+	if local := r.Conn.LocalAddr().(*net.TCPAddr); dst.IP.Equal(local.IP) && dst.Port == local.Port {
+		return nil, errNotRedirected
+	}
+	return dst, nil
+}
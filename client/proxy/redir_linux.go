@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	ipv6Transparent = 75 // IPV6_TRANSPARENT
+)
+
+// originalDst reads the destination of a connection before iptables REDIRECT rewrote it.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("Not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var serr error
+	ipv4 := tc.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	err = raw.Control(func(fd uintptr) {
+		if ipv4 {
+			// sockaddr_in fits into IPv6Mreq: family(2) | port(2) | addr(4)
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			b := mreq.Multiaddr
+			dst = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(b[2])<<8 | int(b[3])}
+			return
+		}
+		// sockaddr_in6 fits into IPv6MTUInfo
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		dst = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(port[0])<<8 | int(port[1])}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, serr
+}
+
+// ListenRedirect listens on addr for connections diverted by an iptables REDIRECT rule.
+func ListenRedirect(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// ListenTProxy listens on addr with IP_TRANSPARENT set, so it can accept connections
+// diverted by an iptables TPROXY rule. Requires CAP_NET_ADMIN.
+func ListenTProxy(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if serr == nil && network != "tcp4" {
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
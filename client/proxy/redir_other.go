@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+var errRedirPlatform = errors.New("Transparent proxy is only supported on Linux")
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errRedirPlatform
+}
+
+func ListenRedirect(addr string) (net.Listener, error) {
+	return nil, errRedirPlatform
+}
+
+func ListenTProxy(addr string) (net.Listener, error) {
+	return nil, errRedirPlatform
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+)
+
+const (
+	rep4Granted  byte = 0x5a
+	rep4Rejected byte = 0x5b
+)
+
+// socks4 handles SOCKS4 and SOCKS4a requests after the version byte:
+// cmd | port | ip | userid \0 [| host \0 when ip is 0.0.0.x]
+// SOCKS4 cannot carry a password, so it is refused when authentication is required.
+func (p *ProxyClient) socks4(dial Dialer) {
+	head := make([]byte, 7)
+	if _, err := io.ReadFull(p.Conn, head); err != nil {
+		log.Printf("UNABLE TO GET CLIENT REQUEST: %v", err)
+		defer p.Conn.Close()
+		return
+	}
+	cmd, port, ip := head[0], head[1:3], head[3:7]
+
+	if _, err := p.readString(); err != nil {
+		log.Printf("UNABLE TO GET CLIENT REQUEST: %v", err)
+		defer p.Conn.Close()
+		return
+	}
+
+	addr := append([]byte{atypIPv4}, ip...)
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := p.readString()
+		if err != nil || len(host) == 0 {
+			log.Printf("UNABLE TO GET DST ADDRESS: %v", err)
+			defer p.Conn.Close()
+			return
+		}
+		addr = append([]byte{atypDomain, byte(len(host))}, host...)
+	}
+	addr = append(addr, port...)
+
+	if p.auth != nil || (cmd != cmdConnect && cmd != cmdBind) {
+		log.Printf("SOCKS4 REQUEST REFUSED: %s, CMD: %d", p.Conn.RemoteAddr(), cmd)
+		p.reply4(rep4Rejected, nil)
+		defer p.Conn.Close()
+		return
+	}
+
+	if cmd == cmdConnect {
+		dst, rep, bind := open(dial, p.router, addr)
+		if rep != repSucceeded {
+			p.reply4(rep4Rejected, nil)
+			defer p.Conn.Close()
+			return
+		}
+		if err := p.reply4(rep4Granted, bind); err != nil {
+			defer p.Conn.Close()
+			defer dst.Close()
+			return
+		}
+		Pipe(p.Conn, dst)
+		return
+	}
+
+	src, err := dial()
+	if err != nil {
+		log.Println("SOCKS SERVER UNREACHABLE: ", err)
+		p.reply4(rep4Rejected, nil)
+		defer p.Conn.Close()
+		return
+	}
+	if _, err := src.Write(append([]byte{cmd}, addr...)); err != nil {
+		log.Printf("UNABLE TO SEND REQUEST: %v", err)
+		p.reply4(rep4Rejected, nil)
+		defer p.Conn.Close()
+		defer src.Close()
+		return
+	}
+
+	// BIND answers twice: the listening address, then the inbound peer.
+	if !p.relayReply4(src) || !p.relayReply4(src) {
+		defer p.Conn.Close()
+		defer src.Close()
+		return
+	}
+
+	Pipe(p.Conn, src)
+}
+
+// relayReply4 forwards one server reply as a SOCKS4 reply and reports whether it succeeded.
+func (p *ProxyClient) relayReply4(src net.Conn) bool {
+	rep, bind, err := readReply(src)
+	if err != nil {
+		log.Printf("UNABLE TO GET SERVER RESPONSE: %v", err)
+		rep = repFailure
+	}
+	if rep != repSucceeded {
+		p.reply4(rep4Rejected, nil)
+		return false
+	}
+	return p.reply4(rep4Granted, bind) == nil
+}
+
+// reply4 sends 0 | rep | port | ip, zeroed unless bind is an IPv4 address in wire form.
+func (p *ProxyClient) reply4(rep byte, bind []byte) error {
+	buf := []byte{0x00, rep, 0, 0, 0, 0, 0, 0}
+	if len(bind) == 1+net.IPv4len+2 && bind[0] == atypIPv4 {
+		copy(buf[2:4], bind[5:7])
+		copy(buf[4:8], bind[1:5])
+	}
+	_, err := p.Conn.Write(buf)
+	return err
+}
+
+// readString reads a NUL terminated string of at most 255 bytes.
+func (p *ProxyClient) readString() (string, error) {
+	var buf []byte
+	for {
+		if _, err := io.ReadFull(p.Conn, p.rBuf[:1]); err != nil {
+			return "", err
+		}
+		if p.rBuf[0] == 0x00 {
+			return string(buf), nil
+		}
+		if buf = append(buf, p.rBuf[0]); len(buf) > 255 {
+			return "", errors.New("String too long")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+)
+
+const maxDatagram int = 65535
+
+// associate opens a local UDP relay next to the SOCKS listener and carries its datagrams
+// through the tunnel as len(2) | atyp | addr | port | data until the control connection closes.
+func (p *ProxyClient) associate(dial Dialer, addr []byte) {
+	local := p.Conn.LocalAddr().(*net.TCPAddr)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		log.Printf("UNABLE TO LISTEN UDP: %v", err)
+		p.reply(repFailure, nil)
+		p.Conn.Close()
+		return
+	}
+
+	src, err := dial()
+	if err != nil {
+		log.Println("SOCKS SERVER UNREACHABLE: ", err)
+		p.reply(repFailure, nil)
+		conn.Close()
+		p.Conn.Close()
+		return
+	}
+
+	if _, err := src.Write(append([]byte{cmdUDP}, addr...)); err != nil {
+		log.Printf("UNABLE TO SEND REQUEST: %v", err)
+		p.reply(repFailure, nil)
+		conn.Close()
+		p.Conn.Close()
+		src.Close()
+		return
+	}
+	rep, _, err := readReply(src)
+	if err != nil {
+		log.Printf("UNABLE TO GET SERVER RESPONSE: %v", err)
+		rep = repFailure
+	}
+	bind := conn.LocalAddr().(*net.UDPAddr)
+	if err := p.reply(rep, encodeAddr(bind.IP, bind.Port)); err != nil || rep != repSucceeded {
+		conn.Close()
+		p.Conn.Close()
+		src.Close()
+		return
+	}
+
+	// The association lives as long as the control connection.
+	go func() {
+		io.Copy(ioutil.Discard, p.Conn)
+		conn.Close()
+		src.Close()
+	}()
+
+	var mu sync.Mutex
+	var app *net.UDPAddr
+	go func() {
+		defer conn.Close()
+		defer p.Conn.Close()
+		head := make([]byte, 2)
+		buf := make([]byte, 3+maxDatagram)
+		for {
+			if _, err := io.ReadFull(src, head); err != nil {
+				return
+			}
+			frame := buf[:3+int(binary.BigEndian.Uint16(head))]
+			if _, err := io.ReadFull(src, frame[3:]); err != nil {
+				return
+			}
+			mu.Lock()
+			to := app
+			mu.Unlock()
+			if to != nil {
+				conn.WriteToUDP(frame, to)
+			}
+		}
+	}()
+
+	defer src.Close()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// Only the client owning the control connection may use the relay, fragments are dropped.
+		if !from.IP.Equal(p.Conn.RemoteAddr().(*net.TCPAddr).IP) || n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		mu.Lock()
+		app = from
+		mu.Unlock()
+
+		r := bytes.NewReader(buf[4:n])
+		if _, err := readAddr(r, buf[3]); err != nil {
+			continue
+		}
+		frame := make([]byte, 2, 2+n-3)
+		binary.BigEndian.PutUint16(frame, uint16(n-3))
+		if _, err := src.Write(append(frame, buf[3:n]...)); err != nil {
+			return
+		}
+	}
+}
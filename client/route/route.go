@@ -0,0 +1,196 @@
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Action int
+
+const (
+	Tunnel Action = iota
+	Direct
+	Block
+)
+
+func (a Action) String() string {
+	switch a {
+	case Direct:
+		return "DIRECT"
+	case Block:
+		return "BLOCK"
+	}
+	return "TUNNEL"
+}
+
+type Rule struct {
+	Kind   string
+	Value  string
+	Action Action
+	Line   int
+	re     *regexp.Regexp
+	cidr   *net.IPNet
+	low    int
+	high   int
+}
+
+// Router matches requests against rules in file order, the first hit decides.
+// A nil Router sends everything through the tunnel.
+type Router struct {
+	rules []*Rule
+	final Action
+}
+
+// Load reads a rules file with one TYPE,VALUE,ACTION rule per line, e.g.
+//
+//	DOMAIN-SUFFIX,corp.example.com,DIRECT
+//	DOMAIN-KEYWORD,tracker,BLOCK
+//	DOMAIN,example.com,TUNNEL
+//	DOMAIN-REGEX,^cdn[0-9]+\.example\.net$,DIRECT
+//	IP-CIDR,10.0.0.0/8,DIRECT
+//	PORT,25,BLOCK
+//	FINAL,TUNNEL
+//
+// Empty lines and lines starting with # are ignored.
+func Load(path string) (*Router, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := &Router{final: Tunnel}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// The value may itself contain commas (e.g. a regex), so the type ends at the first
+		// comma and the action starts after the last one.
+		fields := strings.SplitN(line, ",", 2)
+		kind := strings.ToUpper(strings.TrimSpace(fields[0]))
+		if kind == "FINAL" || kind == "MATCH" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expected FINAL,ACTION", n)
+			}
+			if r.final, err = parseAction(strings.TrimSpace(fields[1])); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			continue
+		}
+		i := -1
+		if len(fields) == 2 {
+			i = strings.LastIndexByte(fields[1], ',')
+		}
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected TYPE,VALUE,ACTION", n)
+		}
+		value, action := strings.TrimSpace(fields[1][:i]), strings.TrimSpace(fields[1][i+1:])
+		rule, err := parseRule(kind, value, action)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rule.Line = n
+		r.rules = append(r.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("LOADED %d ROUTING RULES FROM %s, FINAL: %s", len(r.rules), path, r.final)
+	return r, nil
+}
+
+func parseRule(kind, value, action string) (*Rule, error) {
+	rule := &Rule{Kind: kind, Value: value}
+	var err error
+	if rule.Action, err = parseAction(action); err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD":
+		rule.Value = strings.TrimSuffix(strings.ToLower(value), ".")
+	case "DOMAIN-REGEX":
+		if rule.re, err = regexp.Compile(value); err != nil {
+			return nil, err
+		}
+	case "IP-CIDR", "IP-CIDR6":
+		if _, rule.cidr, err = net.ParseCIDR(value); err != nil {
+			return nil, err
+		}
+	case "PORT":
+		low, high := value, value
+		if i := strings.IndexByte(value, '-'); i != -1 {
+			low, high = value[:i], value[i+1:]
+		}
+		if rule.low, err = strconv.Atoi(low); err != nil {
+			return nil, err
+		}
+		if rule.high, err = strconv.Atoi(high); err != nil {
+			return nil, err
+		}
+		if rule.low < 1 || rule.high > 65535 || rule.low > rule.high {
+			return nil, fmt.Errorf("invalid port range %s", value)
+		}
+	default:
+		return nil, fmt.Errorf("unknown rule type %s", kind)
+	}
+	return rule, nil
+}
+
+func parseAction(s string) (Action, error) {
+	switch strings.ToUpper(s) {
+	case "TUNNEL", "PROXY":
+		return Tunnel, nil
+	case "DIRECT":
+		return Direct, nil
+	case "BLOCK", "REJECT":
+		return Block, nil
+	}
+	return Tunnel, fmt.Errorf("unknown action %s", s)
+}
+
+// Match decides the action for host, a domain or an IP literal, and port, and logs the hit.
+// IP-CIDR rules only match IP literals, domains are never resolved locally.
+func (r *Router) Match(host string, port int) Action {
+	if r == nil {
+		return Tunnel
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip := net.ParseIP(host)
+
+	for _, rule := range r.rules {
+		if rule.match(host, ip, port) {
+			log.Printf("ROUTE %s: %s, RULE %d: %s,%s", rule.Action, addr, rule.Line, rule.Kind, rule.Value)
+			return rule.Action
+		}
+	}
+	log.Printf("ROUTE %s: %s, FINAL", r.final, addr)
+	return r.final
+}
+
+func (rule *Rule) match(host string, ip net.IP, port int) bool {
+	switch rule.Kind {
+	case "DOMAIN":
+		return ip == nil && host == rule.Value
+	case "DOMAIN-SUFFIX":
+		return ip == nil && (host == rule.Value || strings.HasSuffix(host, "."+rule.Value))
+	case "DOMAIN-KEYWORD":
+		return ip == nil && strings.Contains(host, rule.Value)
+	case "DOMAIN-REGEX":
+		return ip == nil && rule.re.MatchString(host)
+	case "IP-CIDR", "IP-CIDR6":
+		return ip != nil && rule.cidr.Contains(ip)
+	case "PORT":
+		return port >= rule.low && port <= rule.high
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package ban
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+type host struct {
+	fails int
+	first time.Time
+	until time.Time
+	bans  uint
+}
+
+// Banlist temporarily bans addresses after repeated authentication failures.
+// Each new ban of the same address doubles its duration up to max.
+type Banlist struct {
+	sync.Mutex
+	threshold int
+	window    time.Duration
+	base, max time.Duration
+	allow     []*net.IPNet
+	hosts     map[string]*host
+	sweep     time.Time
+}
+
+func NewBanlist(threshold int, window, base, max time.Duration, allow []*net.IPNet) *Banlist {
+	return &Banlist{
+		threshold: threshold,
+		window:    window,
+		base:      base,
+		max:       max,
+		allow:     allow,
+		hosts:     make(map[string]*host),
+		sweep:     time.Now(),
+	}
+}
+
+func (b *Banlist) Banned(addr net.Addr) bool {
+	ip := hostIP(addr)
+	if b == nil || b.threshold <= 0 || ip == nil {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	h, ok := b.hosts[ip.String()]
+	return ok && time.Now().Before(h.until)
+}
+
+func (b *Banlist) Fail(addr net.Addr) {
+	ip := hostIP(addr)
+	if b == nil || b.threshold <= 0 || ip == nil || b.allowed(ip) {
+		return
+	}
+
+	now := time.Now()
+	b.Lock()
+	defer b.Unlock()
+	b.expire(now)
+
+	h, ok := b.hosts[ip.String()]
+	if !ok {
+		h = &host{}
+		b.hosts[ip.String()] = h
+	}
+	if now.Sub(h.first) > b.window {
+		h.fails, h.first = 0, now
+	}
+	h.fails++
+	if h.fails < b.threshold {
+		return
+	}
+
+	d := b.base
+	for i := uint(0); i < h.bans && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	h.fails, h.until = 0, now.Add(d)
+	h.bans++
+	log.Printf("BANNED %s FOR %v", ip, d)
+}
+
+func (b *Banlist) allowed(ip net.IP) bool {
+	for _, n := range b.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forget addresses that have been quiet for longer than the maximum ban.
+func (b *Banlist) expire(now time.Time) {
+	if now.Sub(b.sweep) < b.window {
+		return
+	}
+	b.sweep = now
+	for k, h := range b.hosts {
+		if now.Sub(h.until) > b.max && now.Sub(h.first) > b.max {
+			delete(b.hosts, k)
+		}
+	}
+}
+
+func hostIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP
+	}
+	return nil
+}
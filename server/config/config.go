@@ -1,6 +1,7 @@
 package config
 
 import (
+	"../ban"
 	"../encrypt"
 	"encoding/json"
 	"flag"
@@ -9,23 +10,67 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
+type Key struct {
+	Psk    string `json:"key"`
+	Expire string `json:"expire"`
+}
+
+type User struct {
+	Name     string `json:"name"`
+	Psk      string `json:"key"`
+	Previous []Key  `json:"previous"`
+}
+
 type Server struct {
-	Socksserver string `json:"socksserver"`
-	Compression string `json:"compression"`
-	Tcpserver   string `json:"tcpserver"`
-	Upstream    string `json:"upstream"`
-	Psk         string `json:"key"`
-	keyring     *encrypt.Keyring
+	Socksserver  string   `json:"socksserver"`
+	Compression  string   `json:"compression"`
+	Cipher       string   `json:"cipher"`
+	Maxframe     int      `json:"maxframe"`
+	Padding      string   `json:"padding"`
+	Mux          bool     `json:"mux"`
+	Udptimeout   int      `json:"udptimeout"`
+	Tcpserver    string   `json:"tcpserver"`
+	Upstream     string   `json:"upstream"`
+	Fallback     string   `json:"fallback"`
+	Timewindow   int      `json:"timewindow"`
+	Timesync     bool     `json:"timesync"`
+	Replaycap    int      `json:"replaycap"`
+	Tarpitbytes  int64    `json:"tarpitbytes"`
+	Tarpithold   int      `json:"tarpithold"`
+	Tarpitdelay  int      `json:"tarpitdelay"`
+	Tarpitconns  int64    `json:"tarpitconns"`
+	Banthreshold int      `json:"banthreshold"`
+	Banwindow    int      `json:"banwindow"`
+	Bantime      int      `json:"bantime"`
+	Banmax       int      `json:"banmax"`
+	Banfallback  bool     `json:"banfallback"`
+	Allowlist    []string `json:"allowlist"`
+	Psk          string   `json:"key"`
+	Previous     []Key    `json:"previous"`
+	Users        []User   `json:"users"`
+	Salt         string   `json:"salt"`
+	Kdftime      uint32   `json:"kdftime"`
+	Kdfmemory    uint32   `json:"kdfmemory"`
+	Kdfthreads   uint8    `json:"kdfthreads"`
+	Legacykdf    bool     `json:"legacykdf"`
+	keyrings     []*encrypt.Keyring
+	options      *encrypt.Options
+	banlist      *ban.Banlist
 }
 
 func LoadServerConf() *Server {
 	socksserver := flag.String("s", "", "Socks server address")
 	tcpserver := flag.String("t", "", "Tcp server address")
 	upstream := flag.String("u", "", "Upstream address")
+	fallback := flag.String("f", "", "Fallback address for illegal connections")
 	config := flag.String("c", "", "Configuration path")
 	comp := flag.String("z", "", "Use compression")
+	cipher := flag.String("m", "", "Cipher method")
+	padding := flag.String("d", "", "Padding policy")
+	multiplex := flag.Bool("x", false, "Multiplex socks connections")
 	Psk := flag.String("p", "", "Pre-shared Keyring")
 	flag.Parse()
 
@@ -50,12 +95,70 @@ func LoadServerConf() *Server {
 	if *upstream != "" {
 		server.Upstream = *upstream
 	}
+	if *fallback != "" {
+		server.Fallback = *fallback
+	}
 	if *comp != "" {
 		server.Compression = *comp
 	}
+	if *cipher != "" {
+		server.Cipher = *cipher
+	}
+	if *padding != "" {
+		server.Padding = *padding
+	}
 	if *Psk != "" {
 		server.Psk = *Psk
 	}
+	if *multiplex {
+		server.Mux = true
+	}
+	if len(server.Salt) == 0 {
+		server.Salt = encrypt.KdfSalt
+	}
+	if server.Kdftime == 0 {
+		server.Kdftime = encrypt.KdfTime
+	}
+	if server.Kdfmemory == 0 {
+		server.Kdfmemory = encrypt.KdfMemory
+	}
+	if server.Kdfthreads == 0 {
+		server.Kdfthreads = encrypt.KdfThreads
+	}
+
+	if server.Timewindow == 0 {
+		server.Timewindow = encrypt.TsRng
+	}
+	if server.Replaycap == 0 {
+		server.Replaycap = encrypt.ReplayCap
+	}
+	if server.Tarpitbytes == 0 {
+		server.Tarpitbytes = encrypt.TarpitBytes
+	}
+	if server.Tarpithold == 0 {
+		server.Tarpithold = encrypt.TarpitHold
+	}
+	if server.Tarpitdelay == 0 {
+		server.Tarpitdelay = encrypt.TarpitDelay
+	}
+	if server.Tarpitconns == 0 {
+		server.Tarpitconns = encrypt.TarpitConns
+	}
+
+	if server.Udptimeout == 0 {
+		server.Udptimeout = 60
+	}
+
+	if server.Banwindow == 0 {
+		server.Banwindow = 600
+	}
+	if server.Bantime == 0 {
+		server.Bantime = 600
+	}
+	if server.Banmax == 0 {
+		server.Banmax = 86400
+	}
+
 	if len(server.Socksserver) == 0 && len(server.Tcpserver)*len(server.Upstream) == 0 {
 		log.Fatalln("INVALID ARGS FOR LISTENING ADDRESS")
 	}
@@ -65,7 +168,40 @@ func LoadServerConf() *Server {
 	if len(server.Tcpserver) > 0 && !validateIP(server.Tcpserver) {
 		log.Fatalln("INVALID TCP SERVER ADDRESS")
 	}
+	if len(server.Fallback) > 0 && !validateIP(server.Fallback) {
+		log.Fatalln("INVALID FALLBACK ADDRESS")
+	}
+
+	if _, err := encrypt.NewAEAD(server.Cipher, new([32]byte)); err != nil {
+		log.Fatalf("INVALID CIPHER: %v", err)
+	}
+	if server.Maxframe != 0 && (server.Maxframe < encrypt.MinFrame || server.Maxframe > 65535) {
+		log.Fatalf("MAXFRAME MUST BE BETWEEN %d AND 65535", encrypt.MinFrame)
+	}
+	if _, err := encrypt.ParsePadding(server.Padding); err != nil {
+		log.Fatalf("INVALID PADDING: %v", err)
+	}
+
+	for _, u := range server.users() {
+		if len(u.Name) == 0 {
+			log.Fatalln("USER NAME MUST NOT BE EMPTY")
+		}
+		for _, k := range u.Previous {
+			if _, err := time.Parse(time.RFC3339, k.Expire); err != nil {
+				log.Fatalf("INVALID EXPIRY FOR USER %s: %v", u.Name, err)
+			}
+		}
+	}
 
+	for _, a := range server.Allowlist {
+		if _, err := parseCIDR(a); err != nil {
+			log.Fatalf("INVALID ALLOWLIST ENTRY: %v", err)
+		}
+	}
+
+	server.Getkeyrings()
+	server.Getoptions()
+	server.Getbanlist()
 	return server
 }
 
@@ -85,9 +221,91 @@ func validateIP(s string) bool {
 	return true
 }
 
-func (s *Server) Getkeyring() *encrypt.Keyring {
-	if s.keyring == nil {
-		s.keyring = encrypt.NewKeyring(s.Psk)
+func (s *Server) Getkeyrings() []*encrypt.Keyring {
+	if s.keyrings == nil {
+		if s.Legacykdf {
+			log.Println("USING LEGACY KEY DERIVATION")
+		}
+		users := s.users()
+		for _, u := range users {
+			k := s.newKeyring(u.Psk)
+			k.User = u.Name
+			s.keyrings = append(s.keyrings, k)
+			for _, p := range u.Previous {
+				k := s.newKeyring(p.Psk)
+				k.User = u.Name
+				k.Expire, _ = time.Parse(time.RFC3339, p.Expire)
+				s.keyrings = append(s.keyrings, k)
+				if time.Now().After(k.Expire) {
+					log.Printf("USER %s: PREVIOUS KEY EXPIRED AT %s", u.Name, p.Expire)
+				} else {
+					log.Printf("USER %s: PREVIOUS KEY ACCEPTED UNTIL %s", u.Name, p.Expire)
+				}
+			}
+		}
+		log.Printf("LOADED %d USER(S)", len(users))
+	}
+	return s.keyrings
+}
+
+func (s *Server) users() []User {
+	if len(s.Psk) > 0 || len(s.Previous) > 0 || len(s.Users) == 0 {
+		return append([]User{{Name: "default", Psk: s.Psk, Previous: s.Previous}}, s.Users...)
+	}
+	return s.Users
+}
+
+func (s *Server) newKeyring(psk string) *encrypt.Keyring {
+	if s.Legacykdf {
+		return encrypt.NewKeyring(psk)
+	}
+	return encrypt.NewKeyringArgon2(psk, s.Salt, s.Kdftime, s.Kdfmemory, s.Kdfthreads)
+}
+
+func (s *Server) Getoptions() *encrypt.Options {
+	if s.options == nil {
+		padding, _ := encrypt.ParsePadding(s.Padding)
+		s.options = &encrypt.Options{
+			Cipher:      s.Cipher,
+			MaxFrame:    s.Maxframe,
+			Padding:     padding,
+			Fallback:    s.Fallback,
+			Window:      s.Timewindow,
+			TimeSync:    s.Timesync,
+			OnIllegal:   s.Getbanlist().Fail,
+			BanFallback: s.Banfallback,
+			ReplayCap:   s.Replaycap,
+			Tarpit: &encrypt.Tarpit{
+				MaxBytes: s.Tarpitbytes,
+				MaxHold:  time.Duration(s.Tarpithold) * time.Second,
+				MaxDelay: time.Duration(s.Tarpitdelay) * time.Second,
+				MaxConns: s.Tarpitconns,
+			},
+		}
+	}
+	return s.options
+}
+
+func (s *Server) Getbanlist() *ban.Banlist {
+	if s.banlist == nil {
+		var allow []*net.IPNet
+		for _, a := range s.Allowlist {
+			n, _ := parseCIDR(a)
+			allow = append(allow, n)
+		}
+		s.banlist = ban.NewBanlist(s.Banthreshold, time.Duration(s.Banwindow)*time.Second, time.Duration(s.Bantime)*time.Second, time.Duration(s.Banmax)*time.Second, allow)
+	}
+	return s.banlist
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
 	}
-	return s.keyring
+	_, n, err := net.ParseCIDR(s)
+	return n, err
 }
@@ -0,0 +1,60 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	Secretbox        string = "secretbox"
+	Chacha20Poly1305 string = "chacha20-poly1305"
+	Aes256Gcm        string = "aes-256-gcm"
+)
+
+func NewAEAD(name string, key *[32]byte) (cipher.AEAD, error) {
+	switch name {
+	case "", Secretbox:
+		return &secretboxAEAD{key: key}, nil
+	case Chacha20Poly1305:
+		return chacha20poly1305.New(key[:])
+	case Aes256Gcm:
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, errors.New("Unsupported cipher " + name)
+}
+
+// Adapts nacl/secretbox to cipher.AEAD, additional data is not supported.
+type secretboxAEAD struct {
+	key *[32]byte
+}
+
+func (s *secretboxAEAD) NonceSize() int {
+	return 24
+}
+
+func (s *secretboxAEAD) Overhead() int {
+	return secretbox.Overhead
+}
+
+func (s *secretboxAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	var n [24]byte
+	copy(n[:], nonce)
+	return secretbox.Seal(dst, plaintext, &n, s.key)
+}
+
+func (s *secretboxAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	var n [24]byte
+	copy(n[:], nonce)
+	p, ok := secretbox.Open(dst, ciphertext, &n, s.key)
+	if !ok {
+		return nil, errors.New("Decryption Failed")
+	}
+	return p, nil
+}
@@ -2,25 +2,115 @@ package encrypt
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
-	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 	"io"
 	"log"
 	mr "math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	TsRng int = 300
+	TsRng          int    = 300
+	TsSync         int    = 3600
+	Version        string = "torii/9"
+	HelloLen       int    = 48
+	ServerHelloLen int    = 56
+	TimeLen        int    = 24
+	MaxFrame       int    = 16384
+	MinFrame       int    = 64
 )
 
+const (
+	KdfSalt    string = "torii"
+	KdfTime    uint32 = 3
+	KdfMemory  uint32 = 64 * 1024
+	KdfThreads uint8  = 4
+)
+
+var (
+	ErrIllegal  = errors.New("ILLEGAL CONNECTION CLOSED")
+	ErrFallback = errors.New("ILLEGAL CONNECTION FORWARDED TO FALLBACK")
+)
+
+type Options struct {
+	Cipher      string
+	MaxFrame    int
+	Padding     *Padding
+	Fallback    string
+	Tarpit      *Tarpit
+	Window      int
+	TimeSync    bool
+	OnIllegal   func(net.Addr)
+	BanFallback bool
+	ReplayCap   int
+	pool        sync.Pool
+	replay      *ReplayFilter
+	once        sync.Once
+}
+
+// Replay filter shared by every connection using these options.
+func (o *Options) filter() *ReplayFilter {
+	o.once.Do(func() {
+		if o.ReplayCap > 0 {
+			o.replay = NewReplayFilter(o.ReplayCap)
+		} else {
+			o.replay = NewReplayFilter(ReplayCap)
+		}
+	})
+	return o.replay
+}
+
+// Reports a failed handshake before the connection is held or forwarded.
+func (o *Options) illegal(addr net.Addr) {
+	if o.OnIllegal != nil {
+		o.OnIllegal(addr)
+	}
+}
+
+func (o *Options) window() int {
+	if o.Window > 0 {
+		return o.Window
+	}
+	return TsRng
+}
+
+func (o *Options) maxFrame() int {
+	if o.MaxFrame > 0 {
+		return o.MaxFrame
+	}
+	return MaxFrame
+}
+
+// Receive buffers hold the sealed frame in the first half and the opened frame in the second.
+func (o *Options) getBuf() *[]byte {
+	if b, ok := o.pool.Get().(*[]byte); ok {
+		return b
+	}
+	b := make([]byte, 2*(o.maxFrame()+64))
+	return &b
+}
+
+func (o *Options) putBuf(b *[]byte) {
+	o.pool.Put(b)
+}
+
 type Keyring struct {
+	sessions, rx, tx uint64
+	User string
+	Expire time.Time
 	k_cipher *[32]byte
-	k_nonce []byte
+	k_auth []byte
 	k_client []byte
 	k_server []byte
 	k_timestamp []byte
@@ -29,14 +119,14 @@ type Keyring struct {
 }
 
 func NewKeyring(s string) *Keyring {
-	k_nonce := SH256L([]byte("k_nonce_" + s))
+	k_auth := SH256L([]byte("k_auth_" + s))
 	k_client := SH256L([]byte("k_client_" + s))
 	k_server := SH256L([]byte("k_server_" + s))
 	k_timestamp := SH256L([]byte("k_timestamp_" + s))
 	k_chksum := SH256L([]byte("k_chksum_" + s))
 	k_cipher := sha256.Sum256([]byte("k_cipher_" + s))
 	return &Keyring{
-		k_nonce: k_nonce,
+		k_auth: k_auth,
 		k_client: k_client,
 		k_server: k_server,
 		k_timestamp: k_timestamp,
@@ -45,100 +135,380 @@ func NewKeyring(s string) *Keyring {
 	}
 }
 
+// Derive subkeys from an Argon2id master key instead of plain SHA-256 of the passphrase.
+// memory is in KiB.
+func NewKeyringArgon2(s, salt string, iter, memory uint32, threads uint8) *Keyring {
+	master := argon2.IDKey([]byte(s), []byte(salt), iter, memory, threads, 32)
+	expand := func(label string) []byte {
+		k := make([]byte, 32)
+		io.ReadFull(hkdf.Expand(sha256.New, master, []byte(label)), k)
+		return k
+	}
+	var k_cipher [32]byte
+	copy(k_cipher[:], expand("k_cipher"))
+	return &Keyring{
+		k_auth: expand("k_auth"),
+		k_client: expand("k_client"),
+		k_server: expand("k_server"),
+		k_timestamp: expand("k_timestamp"),
+		k_chksum: expand("k_chksum"),
+		k_cipher: &k_cipher,
+	}
+}
+
+func (k *Keyring) Stats() (uint64, uint64, uint64) {
+	return atomic.LoadUint64(&k.sessions), atomic.LoadUint64(&k.rx), atomic.LoadUint64(&k.tx)
+}
+
 type EncStreamServer struct {
 	net.Conn
+	keyrings       []*Keyring
 	keyring        *Keyring
+	opts           *Options
 	rBuf, dBuf     []byte
-	rNonce, sNonce [24]byte
+	lBuf, lPlain   []byte
+	seen           *bytes.Buffer
+	pBuf           *[]byte
+	rAEAD, sAEAD   cipher.AEAD
+	rNonce, sNonce []byte
+	once           sync.Once
+	err            error
+}
+
+func NewEncStreamServer(conn net.Conn, keys []*Keyring, opts *Options) *EncStreamServer {
+	return &EncStreamServer{
+		Conn:     conn,
+		keyrings: keys,
+		opts:     opts,
+		dBuf:     make([]byte, 16),
+		seen:     &bytes.Buffer{},
+	}
+}
+
+func (e *EncStreamServer) User() string {
+	if e.keyring == nil {
+		return ""
+	}
+	return e.keyring.User
+}
+
+func (e *EncStreamServer) Handshake() error {
+	e.once.Do(func() {
+		e.err = e.handshake()
+	})
+	return e.err
+}
+
+func (e *EncStreamServer) handshake() error {
+	r := io.TeeReader(e.Conn, e.seen)
+	if n, err := io.ReadFull(r, e.dBuf); err != nil || n != 16 {
+		return err
+	}
+
+	var candidates []*Keyring
+	var skews []int
+	for _, k := range e.keyrings {
+		if size, skew, ok := ServerDecode(e.dBuf, k); ok && size == HelloLen {
+			candidates = append(candidates, k)
+			skews = append(skews, skew)
+		}
+	}
+	if len(candidates) == 0 {
+		log.Println("INVALID PACKET RECEIVED")
+		_, err := e.Drop()
+		return err
+	}
+
+	c := make([]byte, HelloLen)
+	if _, err := io.ReadFull(r, c); err != nil {
+		return err
+	}
+	skew := 0
+	for i, k := range candidates {
+		if hmac.Equal(c[32:], HelloMAC(k, e.dBuf, c[:32])) {
+			e.keyring, skew = k, skews[i]
+			break
+		}
+	}
+	if e.keyring == nil {
+		log.Println("CLIENT AUTHENTICATION FAILED")
+		_, err := e.Drop()
+		return err
+	}
+	// Replays are filtered before anything is sent back. A hello is answered while its
+	// timestamp is within span of the server clock, so it is held until span past the later
+	// of the two. Time reports also need the filter to still hold everything recorded since
+	// the earliest time an answered original could have been seen.
+	span := e.opts.window()
+	if e.opts.TimeSync && TsSync > span {
+		span = TsSync
+	}
+	ttl, since := span+1, time.Now().Unix()-int64(span)
+	if skew > 0 {
+		ttl += skew
+	} else {
+		since += int64(skew)
+	}
+	if e.opts.filter().Check(c[:32], ttl) {
+		log.Printf("REPLAYED HANDSHAKE FOR USER %s", e.keyring.User)
+		_, err := e.Drop()
+		return err
+	}
+	if Abs(skew) > e.opts.window() {
+		log.Printf("INCORRECT TIMESTAMP FOR USER %s, OFFSET %ds", e.keyring.User, skew)
+		if !e.opts.TimeSync || Abs(skew) > TsSync || !e.opts.filter().Covers(since) {
+			_, err := e.Drop()
+			return err
+		}
+		defer e.Conn.Close()
+		report := append(ServerEncode(TimeLen, e.keyring), Timestamp()...)
+		report = append(report, HelloMAC(e.keyring, c[:32], report)...)
+		e.Conn.Write(report)
+		return errors.New("CLIENT CLOCK OUT OF SYNC")
+	}
+	if !e.keyring.Expire.IsZero() {
+		if time.Now().After(e.keyring.Expire) {
+			log.Printf("USER %s PRESENTED A KEY EXPIRED AT %s", e.keyring.User, e.keyring.Expire.Format(time.RFC3339))
+			_, err := e.Drop()
+			return err
+		}
+		log.Printf("USER %s AUTHENTICATED WITH PREVIOUS KEY, EXPIRES AT %s", e.keyring.User, e.keyring.Expire.Format(time.RFC3339))
+	}
+
+	priv, pub, err := Ephemeral()
+	if err != nil {
+		return err
+	}
+	secret, err := curve25519.X25519(priv, c[:32])
+	if err != nil {
+		return err
+	}
+	c2s, s2c := SessionKeys(secret, c[:32], pub, e.keyring)
+	if err := e.setup(c2s, s2c); err != nil {
+		return err
+	}
+	atomic.AddUint64(&e.keyring.sessions, 1)
+	e.seen = nil
+
+	hello := append(ServerEncode(ServerHelloLen, e.keyring), pub...)
+	hello = append(hello, Timestamp()...)
+	hello = append(hello, HelloMAC(e.keyring, c[:32], hello)...)
+	_, err = e.Conn.Write(hello)
+	return err
 }
 
-func NewEncStreamServer(conn net.Conn, keys *Keyring) *EncStreamServer {
-	e := &EncStreamServer{
-		Conn:    conn,
-		keyring: keys,
-		dBuf:    make([]byte, 16),
+func (e *EncStreamServer) setup(rKey, sKey *[32]byte) (err error) {
+	if e.rAEAD, err = NewAEAD(e.opts.Cipher, rKey); err != nil {
+		return err
 	}
-	copy(e.rNonce[:8], keys.k_nonce[24:])
-	copy(e.sNonce[:8], keys.k_nonce[:8])
-	return e
+	if e.sAEAD, err = NewAEAD(e.opts.Cipher, sKey); err != nil {
+		return err
+	}
+	e.rNonce = make([]byte, e.rAEAD.NonceSize())
+	e.sNonce = make([]byte, e.sAEAD.NonceSize())
+	e.lBuf = make([]byte, 2+e.rAEAD.Overhead())
+	e.lPlain = make([]byte, 0, 2)
+	return nil
 }
 
 func (e *EncStreamServer) Read(b []byte) (int, error) {
 	if len(e.rBuf) > 0 {
 		n := copy(b, e.rBuf)
 		e.rBuf = e.rBuf[n:]
+		if len(e.rBuf) == 0 {
+			e.release()
+		}
 		return n, nil
 	}
 
-	if n, err := io.ReadFull(e.Conn, e.dBuf); err != nil || n != 16 {
+	if err := e.Handshake(); err != nil {
 		return 0, err
 	}
 
-	size, ok := ServerDecode(e.dBuf, e.keyring)
-	if !ok {
-		log.Println("INVALID PACKET RECEIVED")
-		return e.Drop()
-	}
-
-	c := make([]byte, size)
-	if _, err := io.ReadFull(e.Conn, c); err != nil {
-		log.Printf("%v", err)
+	p, ok, err := e.readFrame()
+	if err != nil {
 		return 0, err
 	}
-
-	p, ok := secretbox.Open(nil, c[:size], &e.rNonce, e.keyring.k_cipher)
 	if !ok {
-		log.Println("DECRYPTION FAILED")
 		return e.Drop()
 	}
-	increment(&e.rNonce)
+	atomic.AddUint64(&e.keyring.rx, uint64(len(p)))
 
 	n := copy(b, p)
 	if n < len(p) {
 		e.rBuf = p[n:]
+	} else {
+		e.release()
 	}
 
 	return n, nil
 }
 
+func (e *EncStreamServer) release() {
+	if e.pBuf != nil {
+		e.opts.putBuf(e.pBuf)
+		e.pBuf = nil
+	}
+}
+
+func (e *EncStreamServer) readFrame() ([]byte, bool, error) {
+	if _, err := io.ReadFull(e.Conn, e.lBuf); err != nil {
+		return nil, false, err
+	}
+
+	l, err := e.rAEAD.Open(e.lPlain, e.rNonce, e.lBuf, nil)
+	if err != nil {
+		log.Println("INVALID PACKET RECEIVED")
+		return nil, false, nil
+	}
+	increment(e.rNonce)
+
+	size := int(binary.BigEndian.Uint16(l))
+	if size > e.opts.maxFrame() {
+		log.Printf("FRAME TOO LARGE: %d", size)
+		return nil, false, nil
+	}
+
+	e.pBuf = e.opts.getBuf()
+	half := len(*e.pBuf) / 2
+	c := (*e.pBuf)[:size+e.rAEAD.Overhead()]
+	if _, err := io.ReadFull(e.Conn, c); err != nil {
+		log.Printf("%v", err)
+		e.release()
+		return nil, false, err
+	}
+
+	p, err := e.rAEAD.Open((*e.pBuf)[half:half], e.rNonce, c, nil)
+	if err != nil {
+		log.Println("DECRYPTION FAILED")
+		e.release()
+		return nil, false, nil
+	}
+	increment(e.rNonce)
+
+	if len(p) < 2 || int(binary.BigEndian.Uint16(p)) > len(p)-2 {
+		log.Println("INVALID FRAME PADDING")
+		e.release()
+		return nil, false, nil
+	}
+	return p[2 : 2+int(binary.BigEndian.Uint16(p))], true, nil
+}
+
 func (e *EncStreamServer) Write(b []byte) (int, error) {
+	if err := e.Handshake(); err != nil {
+		return 0, err
+	}
+
 	sidx, eidx, chnk := 0, 0, Chunk()
+	if chnk > e.opts.maxFrame()-2 {
+		chnk = e.opts.maxFrame() - 2
+	}
+	if chnk <= 0 {
+		return 0, errors.New("Max frame too small")
+	}
 	for ; sidx < len(b); sidx = eidx {
 		if len(b)-eidx >= chnk {
 			eidx += chnk
 		} else {
 			eidx = len(b)
 		}
-		cipher := secretbox.Seal([]byte{}, b[sidx:eidx], &e.sNonce, e.keyring.k_cipher)
-		increment(&e.sNonce)
-
-		enc_header := ServerEncode(len(cipher), e.keyring)
-		enc_buf := make([]byte, len(enc_header) + len(cipher))
-		
-		copy(enc_buf[:len(enc_header)], enc_header)
-		copy(enc_buf[len(enc_header):], cipher)
-
-		if _, err := e.Conn.Write(enc_buf); err != nil {
+		if _, err := e.Conn.Write(e.seal(b[sidx:eidx])); err != nil {
 			return sidx, err
 		}
+		atomic.AddUint64(&e.keyring.tx, uint64(eidx-sidx))
 	}
 	return sidx, nil
 }
 
+func (e *EncStreamServer) seal(b []byte) []byte {
+	frame := make([]byte, 2+len(b)+e.opts.Padding.Size(len(b), e.opts.maxFrame()))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	l := make([]byte, 2)
+	binary.BigEndian.PutUint16(l, uint16(len(frame)))
+
+	enc_buf := make([]byte, 0, len(l)+len(frame)+2*e.sAEAD.Overhead())
+	enc_buf = e.sAEAD.Seal(enc_buf, e.sNonce, l, nil)
+	increment(e.sNonce)
+	enc_buf = e.sAEAD.Seal(enc_buf, e.sNonce, frame, nil)
+	increment(e.sNonce)
+	return enc_buf
+}
+
 func (e *EncStreamServer) Close() error {
 	return e.Conn.Close()
 }
 
 func (e *EncStreamServer) Drop() (int, error) {
 	defer e.Conn.Close()
-	trap := make([]byte, 16)
-	for {
-		_, err := io.ReadFull(e.Conn, trap)
-		if err != nil {
-			break
+	fallback := e.seen != nil && len(e.opts.Fallback) > 0
+	if e.seen != nil && (!fallback || e.opts.BanFallback) {
+		e.opts.illegal(e.RemoteAddr())
+	}
+	if fallback {
+		if err := e.fallback(); err == nil {
+			return 0, ErrFallback
+		}
+		if !e.opts.BanFallback {
+			e.opts.illegal(e.RemoteAddr())
 		}
 	}
-	return 0, errors.New("ILLEGAL CONNECTION CLOSED")
+	e.opts.Tarpit.Hold(e.Conn)
+	return 0, ErrIllegal
+}
+
+// Replays the bytes consumed by the failed handshake to the fallback and pipes the rest.
+func (e *EncStreamServer) fallback() error {
+	dst, err := net.DialTimeout("tcp", e.opts.Fallback, time.Second*5)
+	if err != nil {
+		log.Printf("FALLBACK UNREACHABLE: %v", err)
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := dst.Write(e.seen.Bytes()); err != nil {
+		log.Printf("FALLBACK UNREACHABLE: %v", err)
+		return err
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(dst, e.Conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(e.Conn, dst)
+		done <- struct{}{}
+	}()
+	<-done
+	return nil
+}
+
+func Ephemeral() ([]byte, []byte, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	return priv, pub, err
+}
+
+func HelloMAC(keys *Keyring, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, keys.k_auth)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)[:16]
+}
+
+func SessionKeys(secret, cPub, sPub []byte, keys *Keyring) (*[32]byte, *[32]byte) {
+	info := append([]byte(Version), cPub...)
+	r := hkdf.New(sha256.New, secret, keys.k_cipher[:], append(info, sPub...))
+	var c2s, s2c [32]byte
+	io.ReadFull(r, c2s[:])
+	io.ReadFull(r, s2c[:])
+	return &c2s, &s2c
 }
 
 func ServerEncode(i int, keys *Keyring) []byte {
@@ -156,29 +526,31 @@ func ServerEncode(i int, keys *Keyring) []byte {
 	return head
 }
 
-func ServerDecode(b []byte, keys *Keyring) (int, bool) {
+// Returns the frame size and the offset of the client clock in seconds.
+func ServerDecode(b []byte, keys *Keyring) (int, int, bool) {
 	hBuf := make([]byte, 36)
-	copy(hBuf[:4], b[:4])
+	copy(hBuf[:12], b[:12])
+	copy(hBuf[12:], keys.k_chksum[:24])
+	if !bytes.Equal(b[12:16], SH256S(hBuf)) {
+		return 0, 0, false
+	}
 
 	copy(hBuf[4:], keys.k_timestamp)
 	iBuf := XORBytes(b[4:8], SH256S(hBuf))
-	if Abs(int(time.Now().Unix())-int(binary.LittleEndian.Uint32(iBuf))) > TsRng {
-		log.Println("INCORRECT TIMESTAMP")
-		return 0, false
-	}
+	skew := int(binary.LittleEndian.Uint32(iBuf)) - int(time.Now().Unix())
 
 	copy(hBuf[4:8], b[4:8])
 	copy(hBuf[8:], keys.k_client[4:])
 	iBuf = XORBytes(b[8:12], SH256S(hBuf))
 	i := int(binary.LittleEndian.Uint32(iBuf))
 
-	copy(hBuf[:12], b[:12])
-	copy(hBuf[12:], keys.k_chksum[:24])
-	if !bytes.Equal(b[12:16], SH256S(hBuf)) {
-		return 0, false
-	}
+	return i, skew, true
+}
 
-	return i, true
+func Timestamp() []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+	return b
 }
 
 func XORBytes(a, b []byte) []byte {
@@ -189,7 +561,7 @@ func XORBytes(a, b []byte) []byte {
 	return buf
 }
 
-func increment(b *[24]byte) {
+func increment(b []byte) {
 	for i := range b {
 		b[i]++
 		if b[i] != 0 {
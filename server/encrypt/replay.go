@@ -0,0 +1,74 @@
+package encrypt
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	ReplayCap int = 65536
+)
+
+type ReplayFilter struct {
+	sync.Mutex
+	seen    map[string]int64
+	order   []string
+	cap     int
+	lost    int64
+	evicted int
+	warned  int64
+}
+
+func NewReplayFilter(cap int) *ReplayFilter {
+	return &ReplayFilter{
+		seen: make(map[string]int64),
+		cap:  cap,
+		lost: time.Now().Unix(),
+	}
+}
+
+// Check records b for ttl seconds and reports whether it is already held.
+// Entries are dropped from the front once expired, so one with a longer ttl may hold
+// expired ones behind it until they are evicted for room.
+func (f *ReplayFilter) Check(b []byte, ttl int) bool {
+	now := time.Now().Unix()
+	k := string(b)
+
+	f.Lock()
+	defer f.Unlock()
+
+	for len(f.order) > 0 && f.seen[f.order[0]] <= now {
+		delete(f.seen, f.order[0])
+		f.order = f.order[1:]
+	}
+
+	if _, ok := f.seen[k]; ok {
+		return true
+	}
+	for len(f.order) > 0 && len(f.order) >= f.cap {
+		if f.seen[f.order[0]] > now {
+			f.lost = now
+			f.evicted++
+		}
+		delete(f.seen, f.order[0])
+		f.order = f.order[1:]
+	}
+	// Evicting live entries lets their replays through, warn at most once a minute.
+	if f.evicted > 0 && now-f.warned >= 60 {
+		log.Printf("REPLAY FILTER FULL, %d HANDSHAKES EVICTED BEFORE THEIR TTL, RAISE REPLAYCAP", f.evicted)
+		f.evicted, f.warned = 0, now
+	}
+	f.seen[k] = now + int64(ttl)
+	f.order = append(f.order, k)
+	return false
+}
+
+// Covers reports whether everything recorded since t is still held, i.e. no entry
+// recorded at or after t was evicted before its ttl to make room. Nothing recorded
+// before the filter was created is covered.
+func (f *ReplayFilter) Covers(t int64) bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.lost < t
+}
@@ -0,0 +1,128 @@
+package encrypt
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	client "../../client/encrypt"
+)
+
+func TestReplayFilterTTL(t *testing.T) {
+	f := NewReplayFilter(16)
+	if f.Check([]byte("a"), 60) {
+		t.Fatal("first sighting reported as replay")
+	}
+	if !f.Check([]byte("a"), 60) {
+		t.Fatal("replay within ttl not detected")
+	}
+
+	f = NewReplayFilter(16)
+	f.Check([]byte("b"), 0)
+	if f.Check([]byte("b"), 0) {
+		t.Fatal("entry outlived its ttl")
+	}
+}
+
+func TestReplayFilterRestart(t *testing.T) {
+	f := NewReplayFilter(16)
+	if f.Covers(time.Now().Unix() - 1) {
+		t.Fatal("time before the filter existed reported as covered")
+	}
+}
+
+func TestReplayFilterEviction(t *testing.T) {
+	f := NewReplayFilter(1)
+	f.lost = 0
+	f.Check([]byte("a"), 60)
+	f.Check([]byte("b"), 60)
+	if f.Covers(time.Now().Unix()) {
+		t.Fatal("live entry evicted without losing coverage")
+	}
+}
+
+func TestReplayFilterCapacity(t *testing.T) {
+	f := NewReplayFilter(2)
+	for _, k := range []string{"a", "b", "c"} {
+		if f.Check([]byte(k), 60) {
+			t.Fatalf("first sighting of %s reported as replay", k)
+		}
+	}
+	if f.Check([]byte("a"), 60) {
+		t.Fatal("oldest entry kept beyond capacity")
+	}
+	if !f.Check([]byte("c"), 60) {
+		t.Fatal("newest entry evicted")
+	}
+}
+
+// record captures the hello a client sends for psk.
+func record(t *testing.T, psk string) []byte {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go client.NewEncStreamClient(a, client.NewKeyring(psk), &client.Options{}).Handshake()
+	hello := make([]byte, 16+HelloLen)
+	if _, err := io.ReadFull(b, hello); err != nil {
+		t.Fatal(err)
+	}
+	return hello
+}
+
+// forge builds a hello for psk from a client whose clock is skew seconds ahead.
+func forge(psk string, skew int64) []byte {
+	keys := client.NewKeyring(psk)
+	_, pub, _ := client.Ephemeral()
+	hello := append(client.ClientEncode(HelloLen, keys, skew), pub...)
+	return append(hello, client.HelloMAC(keys, hello)...)
+}
+
+// present sends hello to a fresh server and returns the result of its handshake.
+func present(psk string, hello []byte, opts *Options) error {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	s := NewEncStreamServer(b, []*Keyring{NewKeyring(psk)}, opts)
+	go func() {
+		a.Write(hello)
+		a.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		io.Copy(ioutil.Discard, a)
+		a.Close()
+	}()
+	return s.Handshake()
+}
+
+func TestReplayedHandshake(t *testing.T) {
+	hello := record(t, "psk")
+	opts := &Options{}
+	if err := present("psk", hello, opts); err != nil {
+		t.Fatalf("first handshake rejected: %v", err)
+	}
+	if err := present("psk", hello, opts); err != ErrIllegal && err != ErrFallback {
+		t.Fatalf("replayed handshake not dropped: %v", err)
+	}
+}
+
+func TestReplayedTimeReport(t *testing.T) {
+	// Right after a start nothing recorded earlier is known, so no report is sent.
+	if err := present("psk", forge("psk", 3000), &Options{TimeSync: true}); err != ErrIllegal {
+		t.Fatalf("time report sent without coverage: %v", err)
+	}
+
+	opts := &Options{TimeSync: true}
+	opts.filter().lost = 0
+	hello := forge("psk", 3000)
+	if err := present("psk", hello, opts); err == nil || err == ErrIllegal || err == ErrFallback {
+		t.Fatalf("time report not sent: %v", err)
+	}
+	// The hello must be held for as long as it would be answered, counted from the client clock.
+	if exp := opts.filter().seen[string(hello[16:48])]; exp < time.Now().Unix()+3000+int64(TsSync) {
+		t.Fatalf("hello held until %d only", exp)
+	}
+	if err := present("psk", hello, opts); err != ErrIllegal && err != ErrFallback {
+		t.Fatalf("replayed hello answered: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package encrypt
+
+import (
+	"io"
+	"io/ioutil"
+	mr "math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TarpitBytes int64 = 1 << 20
+	TarpitHold  int   = 120
+	TarpitDelay int   = 5
+	TarpitConns int64 = 1024
+)
+
+// Tarpit bounds how long and how much an illegal connection is held before it is closed.
+// Zero values disable the corresponding limit.
+type Tarpit struct {
+	active, total, rejected, absorbed int64
+	MaxBytes                          int64
+	MaxHold                           time.Duration
+	MaxDelay                          time.Duration
+	MaxConns                          int64
+}
+
+func (t *Tarpit) Hold(conn net.Conn) {
+	if t == nil {
+		io.Copy(ioutil.Discard, conn)
+		return
+	}
+
+	if n := atomic.AddInt64(&t.active, 1); t.MaxConns > 0 && n > t.MaxConns {
+		atomic.AddInt64(&t.active, -1)
+		atomic.AddInt64(&t.rejected, 1)
+		return
+	}
+	defer atomic.AddInt64(&t.active, -1)
+	atomic.AddInt64(&t.total, 1)
+
+	if t.MaxHold > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.MaxHold))
+	}
+	var r io.Reader = conn
+	if t.MaxBytes > 0 {
+		r = io.LimitReader(conn, t.MaxBytes)
+	}
+	n, _ := io.Copy(ioutil.Discard, r)
+	atomic.AddInt64(&t.absorbed, n)
+
+	if t.MaxDelay > 0 {
+		time.Sleep(time.Duration(mr.Int63n(int64(t.MaxDelay))))
+	}
+}
+
+// Stats returns the number of active, total and rejected tarpitted connections and the bytes absorbed.
+func (t *Tarpit) Stats() (int64, int64, int64, int64) {
+	return atomic.LoadInt64(&t.active), atomic.LoadInt64(&t.total), atomic.LoadInt64(&t.rejected), atomic.LoadInt64(&t.absorbed)
+}
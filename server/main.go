@@ -4,10 +4,12 @@ import (
 	"./compress"
 	"./config"
 	"./encrypt"
+	"./mux"
 	"./proxy"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 func main() {
@@ -18,6 +20,7 @@ func main() {
 		conf: config.LoadServerConf(),
 		wg:   sync.WaitGroup{},
 	}
+	proxy.UDPTimeout = time.Duration(server.conf.Udptimeout) * time.Second
 
 	if len(server.conf.Tcpserver)*len(server.conf.Upstream) > 0 {
 		tcp := initAddr("TCP SERVER", server.conf.Tcpserver)
@@ -31,6 +34,10 @@ func main() {
 					log.Printf("FAILED TO ACCEPT TCP CONNECTION: %v", err)
 					continue
 				}
+				if server.conf.Getbanlist().Banned(src.RemoteAddr()) {
+					src.Close()
+					continue
+				}
 				dst, err := net.Dial("tcp", server.conf.Upstream)
 				if err != nil {
 					log.Printf("UPSTREAM SERVICE UNREACHABLE: %v", err)
@@ -53,11 +60,16 @@ func main() {
 					log.Printf("FAILED TO ACCEPT SOCKS CONNECTION: %v", err)
 					continue
 				}
+				if server.conf.Getbanlist().Banned(client.RemoteAddr()) {
+					client.Close()
+					continue
+				}
 				go socks5(client, server.conf)
 			}
 		}()
 	}
 
+	go report(server.conf)
 	server.wg.Wait()
 }
 
@@ -71,21 +83,44 @@ func initAddr(name, addr string) net.Listener {
 }
 
 func socks5(client net.Conn, conf *config.Server) {
-	eStream := encrypt.NewEncStreamServer(client, conf.Getkeyring())
+	eStream := encrypt.NewEncStreamServer(client, conf.Getkeyrings(), conf.Getoptions())
+	if !handshake(eStream) {
+		return
+	}
+	if !conf.Mux {
+		serve(eStream, eStream.User(), conf)
+		return
+	}
+	session := mux.Server(eStream)
+	defer session.Close()
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go serve(stream, eStream.User(), conf)
+	}
+}
+
+func serve(conn net.Conn, user string, conf *config.Server) {
 	switch conf.Compression {
 	case "snappy":
-		cStream := compress.NewSnappyStream(eStream)
-		proxy.NewProxyServer(cStream).Connect()
+		cStream := compress.NewSnappyStream(conn)
+		proxy.NewProxyServer(cStream, user).Connect()
 	case "brotli":
-		cStream := compress.NewBrotliStream(eStream)
-		proxy.NewProxyServer(cStream).Connect()
+		cStream := compress.NewBrotliStream(conn)
+		proxy.NewProxyServer(cStream, user).Connect()
 	default:
-		proxy.NewProxyServer(eStream).Connect()
+		proxy.NewProxyServer(conn, user).Connect()
 	}
 }
 
 func forward(src, dst net.Conn, conf *config.Server) {
-	eStream := encrypt.NewEncStreamServer(src, conf.Getkeyring())
+	eStream := encrypt.NewEncStreamServer(src, conf.Getkeyrings(), conf.Getoptions())
+	if !handshake(eStream) {
+		dst.Close()
+		return
+	}
 	switch conf.Compression {
 	case "snappy":
 		cStream := compress.NewSnappyStreamServer(eStream)
@@ -97,3 +132,26 @@ func forward(src, dst net.Conn, conf *config.Server) {
 		proxy.Pipe(eStream, dst)
 	}
 }
+
+func handshake(e *encrypt.EncStreamServer) bool {
+	if err := e.Handshake(); err != nil {
+		log.Printf("HANDSHAKE FAILED: %v", err)
+		return false
+	}
+	return true
+}
+
+func report(conf *config.Server) {
+	for range time.Tick(10 * time.Minute) {
+		active, total, rejected, absorbed := conf.Getoptions().Tarpit.Stats()
+		log.Printf("STATS TARPIT ACTIVE: %d, TOTAL: %d, REJECTED: %d, ABSORBED: %d", active, total, rejected, absorbed)
+		for _, k := range conf.Getkeyrings() {
+			sessions, rx, tx := k.Stats()
+			if k.Expire.IsZero() {
+				log.Printf("STATS USER: %s, SESSIONS: %d, RX: %d, TX: %d", k.User, sessions, rx, tx)
+			} else {
+				log.Printf("STATS USER: %s (PREVIOUS KEY, EXPIRES AT %s), SESSIONS: %d, RX: %d, TX: %d", k.User, k.Expire.Format(time.RFC3339), sessions, rx, tx)
+			}
+		}
+	}
+}
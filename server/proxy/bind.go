@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// BindTimeout is how long a BIND listener waits for the inbound connection.
+var BindTimeout = 2 * time.Minute
+
+// bind listens on the address the server would use to reach addr, reports it,
+// then reports and pipes the first inbound connection.
+func (p *ProxyServer) bind(addr string) {
+	local := &net.TCPAddr{}
+	if probe, err := net.Dial("udp", addr); err == nil {
+		local.IP = probe.LocalAddr().(*net.UDPAddr).IP
+		probe.Close()
+	}
+
+	ln, err := net.ListenTCP("tcp", local)
+	if err != nil {
+		log.Printf("UNABLE TO BIND: %s, USER: %s, %v", addr, p.user, err)
+		p.reply(repFailure, nil)
+		p.Conn.Close()
+		return
+	}
+	defer ln.Close()
+	log.Printf("BINDING: %s FOR %s, USER: %s", ln.Addr(), addr, p.user)
+
+	if err := p.reply(repSucceeded, ln.Addr()); err != nil {
+		log.Printf("UNABLE TO WRITE RESPONSE: %v", err)
+		p.Conn.Close()
+		return
+	}
+
+	// Only the peer named in the request may connect when it is an IP literal (RFC 1928),
+	// others are closed and the listener keeps waiting.
+	var peer net.IP
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			peer = ip
+		}
+	}
+
+	ln.SetDeadline(time.Now().Add(BindTimeout))
+	var dst net.Conn
+	for {
+		dst, err = ln.Accept()
+		if err != nil {
+			log.Printf("NO INBOUND CONNECTION: %s, USER: %s, %v", ln.Addr(), p.user, err)
+			p.reply(replyCode(err), nil)
+			p.Conn.Close()
+			return
+		}
+		if peer == nil || peer.Equal(dst.RemoteAddr().(*net.TCPAddr).IP) {
+			break
+		}
+		log.Printf("UNEXPECTED INBOUND CONNECTION: %s FOR %s, USER: %s", dst.RemoteAddr(), addr, p.user)
+		dst.Close()
+	}
+
+	if err := p.reply(repSucceeded, dst.RemoteAddr()); err != nil {
+		log.Printf("UNABLE TO WRITE RESPONSE: %v", err)
+		p.Conn.Close()
+		dst.Close()
+		return
+	}
+
+	Pipe(p.Conn, dst)
+}
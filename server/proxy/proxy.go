@@ -2,54 +2,190 @@ package proxy
 
 import (
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"syscall"
 	"time"
 )
 
+const (
+	atypIPv4   byte = 0x01
+	atypDomain byte = 0x03
+	atypIPv6   byte = 0x04
+)
+
+const (
+	cmdConnect byte = 0x01
+	cmdBind    byte = 0x02
+	cmdUDP     byte = 0x03
+)
+
+// SOCKS5 reply codes, sent back to the client as the first byte of the reply.
+const (
+	repSucceeded       byte = 0x00
+	repFailure         byte = 0x01
+	repNetUnreachable  byte = 0x03
+	repHostUnreachable byte = 0x04
+	repRefused         byte = 0x05
+	repTTLExpired      byte = 0x06
+	repCmdUnsupported  byte = 0x07
+	repAtypUnsupported byte = 0x08
+)
+
+var errAtyp = errors.New("Unsupported ATYP")
+
 type ProxyServer struct {
 	rBuf []byte
+	user string
 	net.Conn
 }
 
-func NewProxyServer(conn net.Conn) *ProxyServer {
+func NewProxyServer(conn net.Conn, user string) *ProxyServer {
 	return &ProxyServer{
 		Conn: conn,
+		user: user,
 		rBuf: make([]byte, 2),
 	}
 }
 
 func (p *ProxyServer) Connect() {
 	if _, err := io.ReadFull(p.Conn, p.rBuf[:1]); err != nil {
-		log.Printf("%v", err)
+		log.Printf("UNABLE TO GET REQUEST: %v", err)
 		defer p.Conn.Close()
 		return
 	}
+	cmd := p.rBuf[0]
 
-	length := int(p.rBuf[0])
-	buf := make([]byte, length+2)
-
-	if n, err := io.ReadFull(p.Conn, buf); err != nil || n != length+2 {
+	addr, err := readAddr(p.Conn)
+	if err != nil {
 		log.Printf("ILLEGAL DST: %v", err)
+		if err == errAtyp {
+			p.reply(repAtypUnsupported, nil)
+		}
 		defer p.Conn.Close()
 		return
 	}
 
-	addr := fmt.Sprintf("%s:%d", string(buf[:length]), binary.BigEndian.Uint16(buf[length:]))
-	log.Printf("CONNECTING: %s", addr)
+	switch cmd {
+	case cmdConnect:
+		p.connect(addr)
+	case cmdBind:
+		p.bind(addr)
+	case cmdUDP:
+		p.associate()
+	default:
+		log.Printf("UNSUPPORTED COMMAND: %d, USER: %s", cmd, p.user)
+		p.reply(repCmdUnsupported, nil)
+		p.Conn.Close()
+	}
+}
+
+func (p *ProxyServer) connect(addr string) {
+	log.Printf("CONNECTING: %s, USER: %s", addr, p.user)
 
 	dst, err := net.DialTimeout("tcp", addr, time.Second*15)
 	if err != nil {
-		log.Printf("UNABLE TO CONNECT: %s, %v", addr, err)
+		log.Printf("UNABLE TO CONNECT: %s, USER: %s, %v", addr, p.user, err)
+		p.reply(replyCode(err), nil)
 		defer p.Conn.Close()
 		return
 	}
 
+	if err := p.reply(repSucceeded, dst.LocalAddr()); err != nil {
+		log.Printf("UNABLE TO WRITE RESPONSE: %v", err)
+		defer p.Conn.Close()
+		defer dst.Close()
+		return
+	}
+
 	Pipe(p.Conn, dst)
 }
 
+// reply sends rep | atyp | addr | port
+func (p *ProxyServer) reply(rep byte, addr net.Addr) error {
+	_, err := p.Conn.Write(append([]byte{rep}, encodeAddr(addr)...))
+	return err
+}
+
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return repHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return repRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return repNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return repHostUnreachable
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return repTTLExpired
+	}
+	return repFailure
+}
+
+// readAddr reads a wire address (atyp | addr | port) and returns it as host:port.
+func readAddr(r io.Reader) (string, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head[:1]); err != nil {
+		return "", err
+	}
+
+	var size int
+	switch head[0] {
+	case atypIPv4:
+		size = net.IPv4len
+	case atypIPv6:
+		size = net.IPv6len
+	case atypDomain:
+		if _, err := io.ReadFull(r, head[1:]); err != nil {
+			return "", err
+		}
+		size = int(head[1])
+	default:
+		return "", errAtyp
+	}
+
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	host := string(buf[:size])
+	if head[0] != atypDomain {
+		host = net.IP(buf[:size]).String()
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(buf[size:])))
+	return net.JoinHostPort(host, port), nil
+}
+
+// encodeAddr returns addr in wire form, 0.0.0.0:0 when it is not a TCP or UDP address.
+func encodeAddr(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	buf := []byte{atypIPv4}
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		buf = append(buf, ip4...)
+	} else {
+		buf = append([]byte{atypIPv6}, ip.To16()...)
+	}
+	return append(buf, byte(port>>8), byte(port))
+}
+
 func Pipe(src, dst net.Conn) {
 	go func() {
 		defer src.Close()
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// UDPTimeout closes an association after this long without datagrams in either direction.
+var UDPTimeout = 60 * time.Second
+
+const maxDatagram int = 65535
+
+// associate relays datagrams between the tunnel and a dedicated UDP socket.
+// Each datagram travels through the tunnel as len(2) | atyp | addr | port | data
+func (p *ProxyServer) associate() {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Printf("UNABLE TO LISTEN UDP: %v", err)
+		p.reply(repFailure, nil)
+		p.Conn.Close()
+		return
+	}
+	if err := p.reply(repSucceeded, conn.LocalAddr()); err != nil {
+		log.Printf("UNABLE TO WRITE RESPONSE: %v", err)
+		conn.Close()
+		p.Conn.Close()
+		return
+	}
+	log.Printf("UDP ASSOCIATE: %s, USER: %s", conn.LocalAddr(), p.user)
+
+	active := time.Now().UnixNano()
+	go func() {
+		defer conn.Close()
+		defer p.Conn.Close()
+		resolved := make(map[string]*net.UDPAddr)
+		head := make([]byte, 2)
+		buf := make([]byte, maxDatagram)
+		for {
+			if _, err := io.ReadFull(p.Conn, head); err != nil {
+				return
+			}
+			frame := buf[:binary.BigEndian.Uint16(head)]
+			if _, err := io.ReadFull(p.Conn, frame); err != nil {
+				return
+			}
+			atomic.StoreInt64(&active, time.Now().UnixNano())
+
+			r := bytes.NewReader(frame)
+			addr, err := readAddr(r)
+			if err != nil {
+				log.Printf("ILLEGAL UDP DST: %v", err)
+				continue
+			}
+			dst, ok := resolved[addr]
+			if !ok {
+				if dst, err = net.ResolveUDPAddr("udp", addr); err != nil {
+					log.Printf("UNABLE TO RESOLVE: %s, USER: %s, %v", addr, p.user, err)
+					continue
+				}
+				resolved[addr] = dst
+			}
+			conn.WriteTo(frame[len(frame)-r.Len():], dst)
+		}
+	}()
+
+	defer conn.Close()
+	defer p.Conn.Close()
+	buf := make([]byte, maxDatagram)
+	for {
+		conn.SetReadDeadline(time.Now().Add(UDPTimeout))
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&active)))
+			if e, ok := err.(net.Error); ok && e.Timeout() && idle < UDPTimeout {
+				continue
+			}
+			log.Printf("UDP ASSOCIATION CLOSED: %s, USER: %s", conn.LocalAddr(), p.user)
+			return
+		}
+		atomic.StoreInt64(&active, time.Now().UnixNano())
+
+		addr := encodeAddr(from)
+		if n+len(addr) > maxDatagram {
+			continue
+		}
+		frame := make([]byte, 2, 2+len(addr)+n)
+		binary.BigEndian.PutUint16(frame, uint16(len(addr)+n))
+		frame = append(append(frame, addr...), buf[:n]...)
+		if _, err := p.Conn.Write(frame); err != nil {
+			return
+		}
+	}
+}